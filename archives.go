@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Archive formats the artifacts can be packaged into.
+const (
+	archiveAuto  = "auto"   // Zip for windows targets, gzipped tarball otherwise
+	archiveTarGz = "tar.gz" // Gzipped tarball
+	archiveZip   = "zip"    // Zip archive
+)
+
+// Extensions of the build outputs, dropped from the archive names so libraries
+// are packaged together with their headers.
+var outputExtensions = []string{".exe", ".test", ".so", ".dll", ".dylib", ".a", ".h"}
+
+// validateArchive checks the requested archive format and that all the extra
+// files to bundle into the archives exist.
+func validateArchive(format string, extras []string) error {
+	switch format {
+	case "", archiveAuto, archiveTarGz, archiveZip:
+	default:
+		return fmt.Errorf("invalid archive format %q, must be one of auto, tar.gz or zip", format)
+	}
+	for _, extra := range extras {
+		info, err := os.Stat(extra)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", extra)
+		}
+	}
+	return nil
+}
+
+// archiveEntry is a file to package into an archive, along with the permission
+// bits to store it with.
+type archiveEntry struct {
+	file string      // Path of the file on the host
+	mode os.FileMode // Permission bits of the file within the archive
+}
+
+// outputMode returns the permission bits to archive a build output with. The bits
+// on disk are not relied upon, as they are lost on hosts without a notion of them,
+// unless explicitly requested with -chmod.
+func outputMode(file string) os.FileMode {
+	if perm, err := strconv.ParseUint(*fileMode, 8, 32); err == nil {
+		return os.FileMode(perm)
+	}
+	if strings.HasSuffix(file, ".h") || strings.HasSuffix(file, ".a") || strings.HasSuffix(file, ".debug") {
+		return 0644
+	}
+	return 0755
+}
+
+// archiveName returns the name of the archive to package an output file into,
+// without the extension of the archive format.
+func archiveName(file string) string {
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, ext := range outputExtensions {
+			if strings.HasSuffix(file, ext) {
+				file, trimmed = strings.TrimSuffix(file, ext), true
+			}
+		}
+	}
+	return file
+}
+
+// packageArtifacts wraps the outputs of every target into an archive next to them,
+// bundling the extra files alongside. The format of the archives is picked based
+// on the target platform in auto mode. The created archives are returned, named
+// relative to the output folder.
+func packageArtifacts(folder string, files []string, targets []string, names map[string][]string, format string, extras []string) ([]string, error) {
+	var archives []string
+	contents := make(map[string][]archiveEntry)
+	for _, file := range files {
+		target := outputTarget(file, targets, names)
+		if target == "" {
+			continue
+		}
+		kind := format
+		if kind == archiveAuto {
+			kind = archiveTarGz
+			if goos, _ := splitTarget(target); strings.HasPrefix(goos, "windows") {
+				kind = archiveZip
+			}
+		}
+		archive := archiveName(file) + "." + kind
+		if _, ok := contents[archive]; !ok {
+			archives = append(archives, archive)
+		}
+		contents[archive] = append(contents[archive], archiveEntry{file: filepath.Join(folder, filepath.FromSlash(file)), mode: outputMode(file)})
+	}
+	sort.Strings(archives)
+
+	var bundled []archiveEntry
+	for _, extra := range extras {
+		bundled = append(bundled, archiveEntry{file: extra, mode: 0644})
+	}
+	for _, archive := range archives {
+		var err error
+		dest := filepath.Join(folder, filepath.FromSlash(archive))
+		if strings.HasSuffix(archive, "."+archiveZip) {
+			err = writeZip(dest, append(contents[archive], bundled...))
+		} else {
+			err = writeTarGz(dest, append(contents[archive], bundled...))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", archive, err)
+		}
+	}
+	return archives, nil
+}
+
+// writeTarGz packages the given files into a gzipped tarball, flattened into its
+// root.
+func writeTarGz(archive string, entries []archiveEntry) error {
+	out, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		info, err := os.Stat(entry.file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Base(filepath.ToSlash(entry.file))
+		header.Mode = int64(entry.mode)
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFile(tw, entry.file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeZip packages the given files into a zip archive, flattened into its root.
+func writeZip(archive string, entries []archiveEntry) error {
+	out, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, entry := range entries {
+		info, err := os.Stat(entry.file)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Base(filepath.ToSlash(entry.file))
+		header.Method = zip.Deflate
+		header.SetMode(entry.mode)
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(w, entry.file); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyFile writes the contents of a file into the given writer.
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
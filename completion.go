@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Flags left out of the usage and the completion scripts.
+var hiddenFlags = map[string]bool{"completion": true}
+
+// Known values of the flags taking one of a fixed set, offered for completion.
+var completionValues = map[string][]string{
+	"buildmode":  {"default", "archive", "c-archive", "c-shared", "exe", "pie", "plugin", "shared"},
+	"buildvcs":   {"true", "false", "auto"},
+	"cgo":        {"true", "false", "auto"},
+	"completion": {"bash", "zsh", "fish"},
+	"engine":     {"docker", "podman"},
+	"package":    {"auto", "tar.gz", "zip"},
+	"pull":       {"never", "missing", "always"},
+}
+
+// init completes the known values with the build targets, including wildcards,
+// and their platforms and architectures.
+func init() {
+	targets := []string{"*/*", "darwin/*", "linux/*", "windows/*"}
+	completionValues["targets"] = append(targets, supportedTargets...)
+	for _, target := range supportedTargets {
+		goos, goarch := splitTarget(target)
+		completionValues["goos"] = appendUnique(completionValues["goos"], goos)
+		completionValues["goarch"] = appendUnique(completionValues["goarch"], goarch)
+	}
+}
+
+// usage prints the command line usage, like the default of the flag package but
+// without the hidden flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// completionFlag is a flag as described to the shell completion scripts.
+type completionFlag struct {
+	name   string   // Name of the flag, without the leading dash
+	usage  string   // First line of the usage of the flag
+	bool   bool     // Whether the flag takes no value
+	values []string // Known values of the flag, if any
+}
+
+// completionFlags collects the flags to complete, sorted by name.
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		boolean, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{
+			name:   f.Name,
+			usage:  strings.SplitN(f.Usage, "\n", 2)[0],
+			bool:   ok && boolean.IsBoolFlag(),
+			values: completionValues[f.Name],
+		})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+// completionScript generates the completion script of a shell, covering all the
+// registered flags and the known values of those taking a fixed set.
+func completionScript(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion(completionFlags()), nil
+	case "zsh":
+		return zshCompletion(completionFlags()), nil
+	case "fish":
+		return fishCompletion(completionFlags()), nil
+	default:
+		return "", fmt.Errorf("unsupported shell %q, must be one of bash, zsh or fish", shell)
+	}
+}
+
+// bashCompletion generates a completion script for bash.
+func bashCompletion(flags []completionFlag) string {
+	var names, values, files []string
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+		switch {
+		case len(f.values) > 0:
+			values = append(values, fmt.Sprintf("    -%s|--%s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;", f.name, f.name, shellQuote([]string{strings.Join(f.values, " ")})))
+		case !f.bool:
+			files = append(files, "-"+f.name, "--"+f.name)
+		}
+	}
+	script := new(strings.Builder)
+	fmt.Fprintf(script, "# bash completion for xgo, load with: source <(xgo -completion bash)\n")
+	fmt.Fprintf(script, "_xgo() {\n")
+	fmt.Fprintf(script, "  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(script, "  case \"$prev\" in\n%s\n", strings.Join(values, "\n"))
+	fmt.Fprintf(script, "    %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(files, "|"))
+	fmt.Fprintf(script, "  esac\n")
+	fmt.Fprintf(script, "  if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(script, "    COMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote([]string{strings.Join(names, " ")}))
+	fmt.Fprintf(script, "  else\n")
+	fmt.Fprintf(script, "    COMPREPLY=($(compgen -d -- \"$cur\"))\n")
+	fmt.Fprintf(script, "  fi\n")
+	fmt.Fprintf(script, "}\n")
+	fmt.Fprintf(script, "complete -o filenames -F _xgo xgo\n")
+	return script.String()
+}
+
+// zshCompletion generates a completion script for zsh.
+func zshCompletion(flags []completionFlag) string {
+	escape := strings.NewReplacer("[", "\\[", "]", "\\]", ":", "\\:", "'", "'\\''")
+
+	script := new(strings.Builder)
+	fmt.Fprintf(script, "#compdef xgo\n")
+	fmt.Fprintf(script, "# zsh completion for xgo, load with: source <(xgo -completion zsh)\n")
+	fmt.Fprintf(script, "_xgo() {\n")
+	fmt.Fprintf(script, "  _arguments \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, escape.Replace(f.usage))
+		switch {
+		case len(f.values) > 0:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, escape.Replace(strings.Join(f.values, " ")))
+		case !f.bool:
+			spec += fmt.Sprintf(":%s:_files", f.name)
+		}
+		fmt.Fprintf(script, "    '%s' \\\n", spec)
+	}
+	fmt.Fprintf(script, "    '*:package:_files -/'\n")
+	fmt.Fprintf(script, "}\n")
+	fmt.Fprintf(script, "compdef _xgo xgo\n")
+	return script.String()
+}
+
+// fishCompletion generates a completion script for fish.
+func fishCompletion(flags []completionFlag) string {
+	script := new(strings.Builder)
+	fmt.Fprintf(script, "# fish completion for xgo, load with: xgo -completion fish | source\n")
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c xgo -o %s -d %s", f.name, fishQuote(f.usage))
+		switch {
+		case len(f.values) > 0:
+			line += fmt.Sprintf(" -x -a %s", fishQuote(strings.Join(f.values, " ")))
+		case !f.bool:
+			line += " -r -F"
+		}
+		fmt.Fprintln(script, line)
+	}
+	return script.String()
+}
+
+// fishQuote quotes a string for fish, which escapes quotes within single quoted
+// strings with a backslash instead of closing them.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Project configuration files looked up in the working directory, in order of
+// preference.
+var projectConfigs = []string{".xgo.yaml", ".xgo.yml", ".xgo.json"}
+
+// Separators to join list values with for flags which are not comma separated.
+var listSeparators = map[string]string{
+	"deps": " ",
+}
+
+// loadProjectConfig looks for a project configuration file in the working folder
+// and applies its settings to all the flags not explicitly set on the command
+// line. The name of the loaded file is returned, or empty if none was found.
+func loadProjectConfig() (string, error) {
+	for _, file := range projectConfigs {
+		blob, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		var settings map[string][]string
+		if strings.HasSuffix(file, ".json") {
+			settings, err = parseJSONConfig(blob)
+		} else {
+			settings, err = parseYAMLConfig(blob)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", file, err)
+		}
+		if err := applyProjectConfig(settings); err != nil {
+			return "", fmt.Errorf("%s: %v", file, err)
+		}
+		return file, nil
+	}
+	return "", nil
+}
+
+// applyProjectConfig sets the flags named by the configuration keys, unless they
+// were already given on the command line.
+func applyProjectConfig(settings map[string][]string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := flag.Lookup(key)
+		if f == nil {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		// Repeatable flags take every value separately, others a joined list
+		if _, ok := f.Value.(*stringsFlag); ok {
+			for _, value := range settings[key] {
+				if err := f.Value.Set(value); err != nil {
+					return fmt.Errorf("invalid %s: %v", key, err)
+				}
+			}
+			continue
+		}
+		sep, ok := listSeparators[key]
+		if !ok {
+			sep = ","
+		}
+		if err := f.Value.Set(strings.Join(settings[key], sep)); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig parses a JSON project configuration, an object of scalar or
+// list values keyed by flag name.
+func parseJSONConfig(blob []byte) (map[string][]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(blob, &raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string][]string)
+	for key, value := range raw {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch item := item.(type) {
+			case string:
+				settings[key] = append(settings[key], item)
+			case bool:
+				settings[key] = append(settings[key], strconv.FormatBool(item))
+			case float64:
+				settings[key] = append(settings[key], strconv.FormatFloat(item, 'f', -1, 64))
+			default:
+				return nil, fmt.Errorf("unsupported value for %s", key)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// parseYAMLConfig parses a YAML project configuration. Only the flat subset of
+// YAML needed to mirror the flags is supported: scalar values, inline lists and
+// block lists, keyed by flag name.
+func parseYAMLConfig(blob []byte) (map[string][]string, error) {
+	settings := make(map[string][]string)
+
+	var list string // Key of the block list being parsed, if any
+	for i, line := range strings.Split(string(blob), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		// Collect the items of block lists
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item outside of a list", i+1)
+			}
+			value, err := parseYAMLScalar(strings.TrimPrefix(trimmed, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			settings[list] = append(settings[list], value)
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("line %d: nested values are not supported", i+1)
+		}
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key, value := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+
+		list = ""
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			list, settings[key] = key, []string{}
+		case strings.HasPrefix(value, "["):
+			end := strings.LastIndex(value, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated list", i+1)
+			}
+			settings[key] = []string{}
+			for _, item := range strings.Split(value[1:end], ",") {
+				if strings.TrimSpace(item) == "" {
+					continue
+				}
+				item, err := parseYAMLScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				settings[key] = append(settings[key], item)
+			}
+		default:
+			item, err := parseYAMLScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			settings[key] = []string{item}
+		}
+	}
+	return settings, nil
+}
+
+// parseYAMLScalar parses a plain, single or double quoted YAML scalar, dropping
+// any trailing comment of plain scalars.
+func parseYAMLScalar(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.ReplaceAll(value[1:end], "''", "'"), nil
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// errFreeSpaceUnsupported is returned if the free disk space cannot be queried on
+// the host platform.
+var errFreeSpaceUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+// checkDiskSpace checks the free space on the file systems of the destination
+// folder and, if builds run in containers, of the container storage. Space below
+// the -min-space threshold is warned about along with the disk usage of the
+// engine, or fails with -fail-on-low-space.
+func checkDiskSpace(folder string, containers bool) error {
+	if *minSpace <= 0 {
+		return nil
+	}
+	locations := [][2]string{{"destination folder", folder}}
+	if containers {
+		if root := storageRoot(); root != "" {
+			locations = append(locations, [2]string{*engine + " storage", root})
+		}
+	}
+	var low []string
+	for _, location := range locations {
+		free, err := freeSpace(location[1])
+		if err != nil {
+			log.Printf("DBG: Failed to check free space of %s: %v", location[1], err)
+			continue
+		}
+		log.Printf("INFO: %s free on %s (%s)", formatBytes(free), location[0], location[1])
+		if free < uint64(*minSpace)<<30 {
+			low = append(low, fmt.Sprintf("%s has only %s free", location[0], formatBytes(free)))
+		}
+	}
+	if len(low) == 0 {
+		return nil
+	}
+	if containers {
+		reportStorageUsage()
+	}
+	msg := fmt.Sprintf("%s, below %d GiB", strings.Join(low, " and "), *minSpace)
+	if *failOnSpace {
+		return errors.New(msg)
+	}
+	log.Printf("WARNING: Low disk space: %s. Builds may fail midway.", msg)
+	return nil
+}
+
+// storageRoot returns the folder the container engine stores its images and
+// containers in, or an empty string if it is not accessible from the host, e.g. if
+// the daemon runs remotely or within a virtual machine.
+func storageRoot() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" && !strings.HasPrefix(host, "unix://") {
+		return ""
+	}
+	format := "{{.DockerRootDir}}"
+	if *engine == "podman" {
+		format = "{{.Store.GraphRoot}}"
+	}
+	out, err := exec.Command(*engine, "info", "--format", format).Output()
+	if err != nil {
+		return ""
+	}
+	root := strings.TrimSpace(string(out))
+	if info, err := os.Stat(root); root == "" || err != nil || !info.IsDir() {
+		return ""
+	}
+	return root
+}
+
+// reportStorageUsage logs the disk space used by the container engine, as
+// reported by its system df command, along with how much of it is reclaimable.
+func reportStorageUsage() {
+	out, err := exec.Command(*engine, "system", "df", "--format", "{{.Type}}\t{{.Size}}\t{{.Reclaimable}}").Output()
+	if err != nil {
+		return
+	}
+	var usage []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		usage = append(usage, fmt.Sprintf("%s %s (%s reclaimable)", fields[0], fields[1], fields[2]))
+	}
+	if len(usage) > 0 {
+		log.Printf("INFO: Disk usage of %s: %s", *engine, strings.Join(usage, ", "))
+	}
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -77,6 +77,7 @@ variable "BASE_IMAGE" {
 target "test" {
   inherits = ["_common"]
   context = "./tests"
+  target = "base"
   args = {
     BASE_IMAGE = BASE_IMAGE
   }
@@ -106,6 +107,70 @@ target "test-cpp" {
   }
 }
 
+target "test-vendor" {
+  inherits = ["test"]
+  args = {
+    PROJECT = "./vendor"
+    BRANCH = ""
+  }
+}
+
+target "test-monorepo" {
+  inherits = ["test"]
+  target = "monorepo"
+  args = {
+    PROJECT = "./monorepo"
+  }
+}
+
+target "test-reproducible" {
+  inherits = ["test"]
+  target = "reproducible"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
+target "test-static-pie" {
+  inherits = ["test"]
+  target = "static-pie"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
+target "test-universal" {
+  inherits = ["test"]
+  target = "universal"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
+target "test-filetype" {
+  inherits = ["test"]
+  target = "filetype"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
+target "test-clean" {
+  inherits = ["test"]
+  target = "clean"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
+target "test-nonroot" {
+  inherits = ["test"]
+  target = "nonroot"
+  args = {
+    PROJECT = "./c"
+  }
+}
+
 target "test-ffmerger" {
   inherits = ["test"]
   args = {
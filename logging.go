@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Levels of the log messages, keyed by the prefix of the messages.
+var logLevels = map[string]string{
+	"DBG":     "debug",
+	"INFO":    "info",
+	"WARNING": "warn",
+	"ERROR":   "error",
+}
+
+// logWriter is the output of the standard logger, filtering the messages by the
+// level they are prefixed with and optionally formatting them as JSON lines.
+// Messages without a known level prefix are treated as errors.
+type logWriter struct {
+	out   io.Writer
+	quiet bool // Drop all messages but errors
+	json  bool // Emit every message as a JSON object
+}
+
+// logEntry is a log message formatted as a JSON line.
+type logEntry struct {
+	Time  string `json:"time"`  // Time the message was logged at
+	Level string `json:"level"` // Level of the message
+	Msg   string `json:"msg"`   // Message without the level prefix
+}
+
+// newLogWriter creates a writer for the standard logger, configured with the
+// logging flags.
+func newLogWriter(out io.Writer) *logWriter {
+	return &logWriter{out: out, quiet: *quiet, json: *logJSON}
+}
+
+// Write implements io.Writer, formatting a single message of the logger.
+func (w *logWriter) Write(data []byte) (int, error) {
+	msg := strings.TrimSuffix(string(data), "\n")
+
+	level := "error"
+	if idx := strings.Index(msg, ": "); idx > 0 {
+		if known, ok := logLevels[msg[:idx]]; ok {
+			level, msg = known, msg[idx+2:]
+		}
+	}
+	if w.quiet && level != "error" {
+		return len(data), nil
+	}
+	if !w.json {
+		return w.out.Write(data)
+	}
+	blob, err := json.Marshal(&logEntry{Time: time.Now().UTC().Format(time.RFC3339), Level: level, Msg: msg})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(blob, '\n')); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// logLines is an io.Writer passing every line written into it to the logger, so
+// the output of commands is formatted like the messages of xgo itself.
+type logLines struct{}
+
+// Write implements io.Writer, logging a single line.
+func (logLines) Write(data []byte) (int, error) {
+	log.Print("INFO: " + strings.TrimSuffix(string(data), "\n"))
+	return len(data), nil
+}
+
+// isTerminal checks whether a file is attached to an interactive terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// commandOutput returns the writer to forward the output of a command to, which
+// drops it in quiet mode and passes it through the logger in JSON mode. Output is
+// tagged with the given name, if any. Only terminals get the output as is, others
+// get it split into lines, leaving out the redraws of progress bars. The returned
+// function flushes any partial line left once the command completes.
+func commandOutput(out io.Writer, name string) (io.Writer, func()) {
+	file, ok := out.(*os.File)
+	switch {
+	case *quiet:
+		return io.Discard, func() {}
+	case *logJSON:
+		w := newPrefixWriter(logLines{}, name)
+		return w, func() { w.Flush() }
+	case name != "":
+		w := newPrefixWriter(out, name)
+		return w, func() { w.Flush() }
+	case ok && isTerminal(file):
+		return out, func() {}
+	default:
+		w := newPrefixWriter(out, "")
+		return w, func() { w.Flush() }
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// outputState is the size and modification time of a file in the output folder,
+// used to detect which files a build produced.
+type outputState struct {
+	size    int64
+	modTime time.Time
+}
+
+// snapshotOutputs lists all the files currently within the output folder, keyed
+// by their slash separated path relative to the folder.
+func snapshotOutputs(folder string) (map[string]outputState, error) {
+	files := make(map[string]outputState)
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = outputState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// newOutputs returns the files in the output folder which were created or changed
+// since the given snapshot was taken, sorted by name.
+func newOutputs(folder string, before map[string]outputState) ([]string, error) {
+	after, err := snapshotOutputs(folder)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for file, state := range after {
+		if old, ok := before[file]; ok && old == state {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Layouts of the outputs within the destination folder.
+const (
+	layoutFlat   = "flat"   // All outputs next to each other
+	layoutNested = "nested" // Outputs in an <os>/<arch> subfolder of their target
+)
+
+// nestOutputs moves the output files into a subfolder of the target they were
+// built for, named <os>/<arch> without any platform version. The new names of
+// the files are returned, relative to the output folder. Files not attributable
+// to any target are left in place.
+func nestOutputs(folder string, files []string, targets []string, names map[string][]string) ([]string, error) {
+	var nested []string
+	for _, file := range files {
+		target := outputTarget(file, targets, names)
+		if target == "" {
+			nested = append(nested, file)
+			continue
+		}
+		goos, goarch := splitTarget(target)
+		goos, _ = splitPlatform(goos)
+
+		moved := path.Join(path.Dir(file), goos, goarch, path.Base(file))
+		dest := filepath.Join(folder, filepath.FromSlash(moved))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(filepath.Join(folder, filepath.FromSlash(file)), dest); err != nil {
+			return nil, err
+		}
+		nested = append(nested, moved)
+	}
+	sort.Strings(nested)
+	return nested, nil
+}
+
+// outputSizes returns the size in bytes of every output file in the output folder.
+func outputSizes(folder string, files []string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(folder, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, err
+		}
+		sizes[file] = info.Size()
+	}
+	return sizes, nil
+}
+
+// chmodOutputs sets the permissions of every output file in the output folder.
+func chmodOutputs(folder string, files []string, mode os.FileMode) error {
+	for _, file := range files {
+		if err := os.Chmod(filepath.Join(folder, filepath.FromSlash(file)), mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postBuildCommand returns the command running the post build hook on an output
+// file, with every {} in the hook replaced by the quoted path of the file.
+func postBuildCommand(hook string, file string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", strings.ReplaceAll(hook, "{}", `"`+file+`"`))
+	}
+	return exec.Command("sh", "-c", strings.ReplaceAll(hook, "{}", shellQuote([]string{file})))
+}
+
+// runPostBuild runs the post build hook on every output file in turn, reporting
+// the failures of each. The number of files the hook failed on is returned.
+func runPostBuild(hook string, folder string, files []string) int {
+	var failed int
+	for _, file := range files {
+		log.Printf("INFO: Running post-build command on %s...", file)
+		if err := run(postBuildCommand(hook, filepath.Join(folder, filepath.FromSlash(file)))); err != nil {
+			log.Printf("ERROR: Post-build command failed on %s: %v.", file, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// strictSnapshot takes a snapshot of the output folder to check the outputs of
+// every target against in strict mode, returning nil otherwise.
+func strictSnapshot(folder string) (map[string]outputState, error) {
+	if !*strict || *dryRun {
+		return nil, nil
+	}
+	before, err := snapshotOutputs(folder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot outputs: %v", err)
+	}
+	return before, nil
+}
+
+// checkProduced checks that the build of a target created or changed at least one
+// output attributed to it in the output folder since the given snapshot.
+func checkProduced(folder string, before map[string]outputState, config *ConfigFlags, target string) error {
+	names, err := outputNames(config, []string{target})
+	if err != nil {
+		return err
+	}
+	files, err := newOutputs(folder, before)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if outputTarget(file, []string{target}, names) != "" {
+			return nil
+		}
+	}
+	return errors.New("build succeeded without producing any output")
+}
+
+// staleOutputs returns the files in the output folder which are named like the
+// outputs of a previous build of the same package for any supported target, so
+// they can be removed before building. Files not following the naming scheme
+// are never returned.
+func staleOutputs(folder string, config *ConfigFlags) ([]string, error) {
+	targets := expandTargets([]string{"*/*"})
+	names, err := outputNames(config, targets)
+	if err != nil {
+		return nil, err
+	}
+	// Outputs are matched by their file names, as module paths and the nested
+	// layout place them into subfolders. Packages built together are always
+	// named after their folders.
+	prefixes := []string{path.Base(outputPrefix(config)) + "-"}
+	if configs := packageConfigs(config); len(configs) > 1 {
+		prefixes = prefixes[:0]
+		for _, config := range configs {
+			if config.Package == "" || config.Prefix != "" {
+				prefixes = append(prefixes, path.Base(outputPrefix(config))+"-")
+			} else {
+				prefixes = append(prefixes, path.Base(config.Package)+"-")
+			}
+		}
+	}
+
+	existing, err := snapshotOutputs(folder)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for file := range existing {
+		if *outTemplate == "" && !hasPrefix(path.Base(file), prefixes) {
+			continue
+		}
+		if outputTarget(file, targets, names) != "" {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// outputPrefix returns the name the build script prefixes the outputs with when
+// no template is used: the requested prefix, the module path of local module
+// builds or the name of the package otherwise.
+func outputPrefix(config *ConfigFlags) string {
+	if config.Prefix != "" {
+		return config.Prefix
+	}
+	if isLocal(config.Repository) {
+		if module := modulePath(filepath.Join(config.Repository, config.ModuleDir)); module != "" {
+			return module
+		}
+	}
+	return packageName(config)
+}
+
+// outputTarget returns the target an output file was built for, based on either
+// the templated output names or the os-arch suffix the build script names the
+// outputs with otherwise. An empty string is returned if the file cannot be
+// attributed to any of the targets.
+func outputTarget(file string, targets []string, names map[string][]string) string {
+	name := path.Base(file)
+	for _, target := range targets {
+		if templates, ok := names[target]; ok {
+			for _, templated := range templates {
+				if name == templated || strings.HasPrefix(name, templated+".") {
+					return target
+				}
+			}
+			continue
+		}
+		goos, goarch := splitTarget(target)
+		goos, _ = splitPlatform(goos)
+
+		token := "-" + goos + "-" + goarch
+		idx := strings.LastIndex(name, token)
+		if idx < 0 {
+			continue
+		}
+		if rest := name[idx+len(token):]; rest == "" || strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "-race") {
+			return target
+		}
+	}
+	return ""
+}
+
+// outputInfo is the data made available to the output name template.
+type outputInfo struct {
+	OS      string // Platform the output is built for
+	Arch    string // Architecture the output is built for
+	Version string // Version of the sources being built
+	Package string // Name of the package being built
+}
+
+// outputName renders the output name template for a target, returning an empty
+// string if no template was requested.
+func outputName(config *ConfigFlags, target string) (string, error) {
+	if *outTemplate == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("out").Option("missingkey=error").Parse(*outTemplate)
+	if err != nil {
+		return "", err
+	}
+	goos, goarch := splitTarget(target)
+	goos, _ = splitPlatform(goos)
+
+	name := new(strings.Builder)
+	if err := tmpl.Execute(name, &outputInfo{OS: goos, Arch: goarch, Version: config.Version, Package: packageName(config)}); err != nil {
+		return "", err
+	}
+	return name.String(), nil
+}
+
+// outputNames renders the output name template for all the targets and each of
+// the packages built.
+func outputNames(config *ConfigFlags, targets []string) (map[string][]string, error) {
+	names := make(map[string][]string)
+	for _, config := range packageConfigs(config) {
+		for _, target := range targets {
+			name, err := outputName(config, target)
+			if err != nil {
+				return nil, err
+			}
+			if name != "" {
+				names[target] = append(names[target], name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// packageName returns the name of the package being built, which the outputs
+// are named after unless overridden. Published module versions are named like
+// go install does, skipping the major version suffix of their import path.
+func packageName(config *ConfigFlags) string {
+	path := filepath.Join(config.Repository, config.Package)
+	if isLocal(config.Repository) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	name := filepath.Base(path)
+	if config.ModVersion != "" && len(name) > 1 && name[0] == 'v' && isDigits(name[1:]) && filepath.Dir(path) != "." {
+		name = filepath.Base(filepath.Dir(path))
+	}
+	return name
+}
+
+// sourceVersion returns a version describing the sources being built, derived
+// from the git state of a local repository or the requested revision otherwise.
+func sourceVersion(config *ConfigFlags) string {
+	if config.ModVersion != "" {
+		return config.ModVersion
+	}
+	if !isLocal(config.Repository) {
+		if config.Revision != "" {
+			return config.Revision
+		}
+		return config.Branch
+	}
+	out, err := exec.Command("git", "-C", config.Repository, "describe", "--tags", "--always", "--dirty").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// sourceCommit returns the commit of the sources being built, taken from a local
+// repository or looked up on its remote otherwise. Published module versions are
+// fetched from the module proxy, so they have no commit to look up.
+func sourceCommit(config *ConfigFlags) string {
+	if config.ModVersion != "" {
+		return ""
+	}
+	if isLocal(config.Repository) {
+		out, err := exec.Command("git", "-C", config.Repository, "rev-parse", "HEAD").Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	ref := config.Revision
+	if ref == "" {
+		ref = config.Branch
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	remote := config.Remote
+	if remote == "" {
+		remote = "https://" + config.Repository
+	}
+	out, err := exec.Command("git", "ls-remote", remote, ref).Output()
+	if err != nil {
+		return ""
+	}
+	if fields := strings.Fields(string(out)); len(fields) > 0 {
+		return fields[0]
+	}
+	// Commits are not refs, so a revision not found on the remote is a commit
+	return config.Revision
+}
+
+// stampLdFlags returns the linker flags injecting the version, commit and build
+// date of the sources into the variables named by the -stamp-vars flag. The build
+// date honors SOURCE_DATE_EPOCH for reproducible builds.
+func stampLdFlags(config *ConfigFlags) (string, error) {
+	vars := strings.Split(*stampVars, ",")
+	if len(vars) != 3 {
+		return "", fmt.Errorf("expected 3 variables, got %d", len(vars))
+	}
+	date := time.Now().UTC()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+		}
+		date = time.Unix(secs, 0).UTC()
+	}
+	values := []string{sourceVersion(config), sourceCommit(config), date.Format(time.RFC3339)}
+
+	var flags []string
+	for i, name := range vars {
+		if name = strings.TrimSpace(name); name != "" && values[i] != "" {
+			flags = append(flags, "-X "+name+"="+values[i])
+		}
+	}
+	return strings.Join(flags, " "), nil
+}
+
+// hasPrefix checks if a file path starts with any of the given prefixes.
+func hasPrefix(file string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(file, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile calculates the hex encoded SHA256 checksum of a file.
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Artifact describes a single file produced by the cross compilation.
+type Artifact struct {
+	Target string            `json:"target"`           // Target the file was built for
+	File   string            `json:"file"`             // Path of the file relative to the output folder
+	Size   int64             `json:"size"`             // Size of the file in bytes
+	SHA256 string            `json:"sha256"`           // Hex encoded SHA256 checksum of the file
+	Labels map[string]string `json:"labels,omitempty"` // User defined metadata attached to the file
+}
+
+// Manifest is a machine readable description of the outputs of a build.
+type Manifest struct {
+	Go        string     `json:"go"`                  // Go release used for the cross compilation
+	Toolchain string     `json:"toolchain,omitempty"` // Concrete Go toolchain version the release resolved to
+	Image     string     `json:"image,omitempty"`     // Docker image used for the cross compilation
+	Artifacts []Artifact `json:"artifacts"`           // Files produced by the build
+}
+
+// writeManifest describes the given output files of a build in a JSON manifest,
+// attaching the given labels to every one of them.
+func writeManifest(path string, image string, toolchain string, folder string, files []string, targets []string, names map[string][]string, labels map[string]string) error {
+	manifest := &Manifest{
+		Go:        *goVersion,
+		Toolchain: strings.Trim(toolchain, ","),
+		Image:     image,
+		Artifacts: []Artifact{},
+	}
+	for _, file := range files {
+		abs := filepath.Join(folder, filepath.FromSlash(file))
+
+		info, err := os.Stat(abs)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(abs)
+		if err != nil {
+			return err
+		}
+		manifest.Artifacts = append(manifest.Artifacts, Artifact{
+			Target: outputTarget(file, targets, names),
+			File:   file,
+			Size:   info.Size(),
+			SHA256: sum,
+			Labels: labels,
+		})
+	}
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(blob, '\n'), 0644)
+}
+
+// checksumsFile is the name of the file the output checksums are written into.
+const checksumsFile = "SHA256SUMS"
+
+// writeChecksums writes the SHA256 checksums of the given output files into the
+// output folder, in the format understood by sha256sum -c.
+func writeChecksums(folder string, files []string) error {
+	sums := new(strings.Builder)
+	for _, file := range files {
+		if file == checksumsFile {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(folder, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sums, "%s  %s\n", sum, file)
+	}
+	return os.WriteFile(filepath.Join(folder, checksumsFile), []byte(sums.String()), 0644)
+}
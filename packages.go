@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// resolvePackages splits the requested arguments into the repository to build and
+// the packages within it, relative to the repository root. A single argument keeps
+// selecting the package through -pkg, whereas multiple arguments or "..." patterns
+// select several commands of the same repository to build in one go.
+func resolvePackages(args []string, pkg string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, errors.New("no package requested")
+	}
+	if len(args) == 1 && !strings.HasSuffix(args[0], "...") {
+		if !strings.HasSuffix(pkg, "...") {
+			return args[0], []string{pkg}, nil
+		}
+		if !isLocal(args[0]) {
+			return "", nil, errors.New("package patterns are only supported for local folders")
+		}
+		dirs, err := expandPackages(filepath.Join(args[0], pkg))
+		if err != nil {
+			return "", nil, err
+		}
+		return relativePackages(args[0], dirs)
+	}
+	if pkg != "" {
+		return "", nil, errors.New("sub-package cannot be combined with multiple packages")
+	}
+	local := isLocal(args[0])
+	for _, arg := range args[1:] {
+		if isLocal(arg) != local {
+			return "", nil, errors.New("local folders and remote import paths cannot be mixed")
+		}
+	}
+	// Remote packages are built from the repository of their common import path
+	if !local {
+		root := args[0]
+		for _, arg := range args {
+			if strings.HasSuffix(arg, "...") {
+				return "", nil, errors.New("package patterns are only supported for local folders")
+			}
+			for root != "." && arg != root && !strings.HasPrefix(arg, root+"/") {
+				root = path.Dir(root)
+			}
+		}
+		if root == "." {
+			return "", nil, errors.New("remote packages do not share a common import path")
+		}
+		var packages []string
+		for _, arg := range args {
+			packages = append(packages, strings.TrimPrefix(strings.TrimPrefix(arg, root), "/"))
+		}
+		return root, packages, nil
+	}
+	// Local packages are built from their module root, or their common folder
+	var dirs []string
+	for _, arg := range args {
+		expanded, err := expandPackages(arg)
+		if err != nil {
+			return "", nil, err
+		}
+		dirs = append(dirs, expanded...)
+	}
+	root := moduleRoot(dirs[0])
+	if root == "" {
+		root = dirs[0]
+		for _, dir := range dirs {
+			for dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+				root = filepath.Dir(root)
+			}
+		}
+	}
+	return relativePackages(root, dirs)
+}
+
+// readPackageList reads the packages listed in a file, or in the standard input
+// if the file is "-", one per line. Blank lines and # comments are skipped.
+func readPackageList(file string) ([]string, error) {
+	var (
+		blob []byte
+		err  error
+	)
+	if file == "-" {
+		blob, err = io.ReadAll(os.Stdin)
+	} else {
+		blob, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var packages []string
+	for _, line := range strings.Split(string(blob), "\n") {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			packages = append(packages, line)
+		}
+	}
+	return packages, nil
+}
+
+// expandPackages resolves a local folder into its absolute path, or a folder
+// ending in "..." into all the main packages found within it.
+func expandPackages(pattern string) ([]string, error) {
+	if !strings.HasSuffix(pattern, "...") {
+		dir, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []string{dir}, nil
+	}
+	base, err := filepath.Abs(strings.TrimSuffix(pattern, "..."))
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// Skip all the folders the go tool ignores too
+		if name := info.Name(); path != base && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor") {
+			return filepath.SkipDir
+		}
+		if pack, err := build.ImportDir(path, 0); err == nil && pack.IsCommand() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no main packages matching %s", pattern)
+	}
+	return dirs, nil
+}
+
+// moduleRoot returns the closest folder containing a go.mod file, starting from
+// the given one and walking up, or an empty string if none was found.
+func moduleRoot(dir string) string {
+	for {
+		if fileExists(filepath.Join(dir, "go.mod")) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// modulePath returns the module path declared in the go.mod file of a module
+// root, or an empty string if it cannot be read.
+func modulePath(root string) string {
+	blob, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(blob), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "module ") {
+			return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "module ")), `"`)
+		}
+	}
+	return ""
+}
+
+// changedPackages filters the packages of a local repository, relative to the
+// given folder within it, down to those affected by the changes since a git
+// revision: the ones with changed files in their folder or in the folders of the
+// packages of the same module they import. Changes to the module files or the
+// vendored dependencies affect all of them.
+func changedPackages(repository string, dir string, packages []string, since string) ([]string, error) {
+	root, err := filepath.Abs(repository)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, args := range [][]string{
+		{"diff", "-z", "--name-only", "--relative", since, "--"},
+		{"ls-files", "-z", "--others", "--exclude-standard"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %v", args[0], err)
+		}
+		for _, file := range strings.Split(string(out), "\x00") {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	changed := make(map[string]bool)
+	for _, file := range files {
+		if base := path.Base(file); base == "go.mod" || base == "go.sum" || base == "go.work" || strings.HasPrefix(file, "vendor/") || strings.Contains(file, "/vendor/") {
+			return packages, nil
+		}
+		changed[filepath.Join(root, filepath.FromSlash(path.Dir(file)))] = true
+	}
+	// Local imports are mapped back to folders through the module path
+	base := filepath.Join(root, dir)
+	module, modRoot := "", moduleRoot(base)
+	if modRoot != "" {
+		module = modulePath(modRoot)
+	}
+	context := build.Default
+	context.UseAllFiles = true
+
+	visited := make(map[string]bool)
+	var affected func(dir string) bool
+	affected = func(dir string) bool {
+		if changed[dir] {
+			return true
+		}
+		if visited[dir] {
+			return false
+		}
+		visited[dir] = true
+
+		pack, err := context.ImportDir(dir, 0)
+		if err != nil {
+			return true // Unsure what the package depends on, rebuild to be safe
+		}
+		for _, imp := range pack.Imports {
+			if module != "" && strings.HasPrefix(imp, module+"/") {
+				if affected(filepath.Join(modRoot, filepath.FromSlash(strings.TrimPrefix(imp, module+"/")))) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var selected []string
+	for _, pkg := range packages {
+		if affected(filepath.Join(base, filepath.FromSlash(pkg))) {
+			selected = append(selected, pkg)
+		}
+	}
+	return selected, nil
+}
+
+// relativePackages converts the absolute package folders into slash separated
+// paths relative to the repository root.
+func relativePackages(root string, dirs []string) (string, []string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", nil, err
+	}
+	var packages []string
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(abs, dir)
+		if err != nil {
+			return "", nil, err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", nil, fmt.Errorf("package %s is outside of repository %s", dir, abs)
+		}
+		if rel = filepath.ToSlash(rel); rel == "." {
+			rel = ""
+		}
+		packages = appendUnique(packages, rel)
+	}
+	// Keep the repository relative to the working directory where possible, as
+	// local repositories are recognized by their path prefix
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, abs); err == nil {
+			if !strings.HasPrefix(rel, ".") {
+				rel = "." + string(filepath.Separator) + rel
+			}
+			return rel, packages, nil
+		}
+	}
+	return abs, packages, nil
+}
+
+// mapPrefixes resolves a comma separated list of pkg=prefix mappings into the
+// output prefix of every package, in order, leaving those not mapped empty so
+// they fall back to the default naming. Packages are matched by their path
+// relative to the repository.
+func mapPrefixes(mapping string, packages []string) ([]string, error) {
+	prefixes := make([]string, len(packages))
+	for _, entry := range strings.Split(mapping, ",") {
+		idx := strings.Index(entry, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("%q is not in the form of pkg=prefix", entry)
+		}
+		pkg, prefix := path.Clean(filepath.ToSlash(strings.TrimSpace(entry[:idx]))), strings.TrimSpace(entry[idx+1:])
+		if pkg == "." {
+			pkg = ""
+		}
+		if prefix == "" || strings.ContainsAny(prefix, `/\`) {
+			return nil, fmt.Errorf("invalid prefix %q of %s, must be a plain file name", prefix, entry[:idx])
+		}
+		found := false
+		for i, candidate := range packages {
+			if candidate == pkg {
+				prefixes[i], found = prefix, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("package %s is not being built", entry[:idx])
+		}
+	}
+	return prefixes, nil
+}
+
+// packageConfigs splits a configuration building multiple packages into one for
+// each of the packages, along with their output prefix if mapped.
+func packageConfigs(config *ConfigFlags) []*ConfigFlags {
+	packages := strings.Split(config.Package, ",")
+	if len(packages) == 1 {
+		return []*ConfigFlags{config}
+	}
+	prefixes := strings.Split(config.Prefix, ",")
+	configs := make([]*ConfigFlags, len(packages))
+	for i, pkg := range packages {
+		single := *config
+		single.Package, single.Prefix = pkg, ""
+		if len(prefixes) == len(packages) {
+			single.Prefix = prefixes[i]
+		}
+		configs[i] = &single
+	}
+	return configs
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cachedImage is an xgo image available locally, as listed by the engine.
+type cachedImage struct {
+	ID      string    // Identifier of the image
+	Refs    []string  // References to remove the image by, its ID if untagged
+	Created time.Time // Time the image was built at
+	Size    string    // Size of the image, as formatted by the engine
+}
+
+// Layout of the creation times in image listings, e.g. 2023-01-02 15:04:05 +0000 UTC.
+const imageCreatedLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// cachedImages lists the locally available images of a repository, newest first.
+// The engine lists every tag separately, so they are grouped by image.
+func cachedImages(repository string) ([]cachedImage, error) {
+	out := new(bytes.Buffer)
+	cmd := exec.Command(*engine, "image", "ls", "--format", "{{.Repository}}:{{.Tag}}\t{{.ID}}\t{{.CreatedAt}}\t{{.Size}}", repository)
+	cmd.Stdout = out
+	if err := run(cmd); err != nil {
+		return nil, err
+	}
+	var images []cachedImage
+	index := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		ref := fields[0]
+		if strings.HasSuffix(ref, ":<none>") {
+			ref = fields[1]
+		}
+		if i, ok := index[fields[1]]; ok {
+			images[i].Refs = appendUnique(images[i].Refs, ref)
+			continue
+		}
+		image := cachedImage{ID: fields[1], Refs: []string{ref}, Size: fields[3]}
+		created, err := time.Parse(imageCreatedLayout, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time of %s: %v", ref, err)
+		}
+		image.Created = created
+		index[image.ID] = len(images)
+		images = append(images, image)
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	return images, nil
+}
+
+// pruneImages removes the locally cached images of a repository but the latest
+// keep ones, and of those only the ones older than age if non zero. Images are
+// counted once whatever their number of tags, all of which are removed. The
+// images are listed with their sizes, and removed once confirmed unless told to.
+func pruneImages(repository string, keep int, age time.Duration, confirmed bool) error {
+	images, err := cachedImages(repository)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %v", err)
+	}
+	var prune []cachedImage
+	for i, image := range images {
+		if i < keep || (age > 0 && time.Since(image.Created) < age) {
+			log.Printf("INFO: Keeping %s (%s, created %s)", strings.Join(image.Refs, ", "), image.Size, image.Created.Format("2006-01-02"))
+			continue
+		}
+		log.Printf("INFO: Pruning %s (%s, created %s)", strings.Join(image.Refs, ", "), image.Size, image.Created.Format("2006-01-02"))
+		prune = append(prune, image)
+	}
+	if len(prune) == 0 {
+		log.Printf("INFO: No %s images to prune.", repository)
+		return nil
+	}
+	if *dryRun {
+		log.Printf("INFO: Dry run, keeping all the images.")
+		return nil
+	}
+	if !confirmed {
+		fmt.Fprintf(os.Stderr, "Remove %d %s images? [y/N] ", len(prune), repository)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			log.Printf("INFO: Pruning aborted, keeping all the images.")
+			return nil
+		}
+	}
+	var failed []string
+	for _, image := range prune {
+		// Removing all the tags of an image at once removes the image itself
+		if err := run(exec.Command(*engine, append([]string{"image", "rm"}, image.Refs...)...)); err != nil {
+			log.Printf("WARNING: Failed to remove image %s: %v", image.ID, err)
+			failed = append(failed, image.ID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove %s", strings.Join(failed, ", "))
+	}
+	log.Printf("INFO: Pruned %d images.", len(prune))
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// targetResult is the outcome of the build of a single target, collected across
+// all the Go releases for the build report.
+type targetResult struct {
+	Release  string        // Go release the target was built with
+	Target   string        // Target that was built
+	Err      error         // Failure of the build, nil if it succeeded
+	Duration time.Duration // Time the build took, zero if it never started
+}
+
+// Results of all the target builds of this run, in the order they were requested.
+var targetResults []targetResult
+
+// Report is the summary of a cross compilation, listing the outcome of the build
+// of every target.
+type Report struct {
+	Success bool           `json:"success"` // Whether all the targets were built
+	Targets []TargetReport `json:"targets"` // Outcome of every target build
+}
+
+// TargetReport is the outcome of the build of a single target.
+type TargetReport struct {
+	Go       string   `json:"go,omitempty"`    // Go release if multiple were built
+	Target   string   `json:"target"`          // Target that was built
+	Success  bool     `json:"success"`         // Whether the target was built
+	Error    string   `json:"error,omitempty"` // Failure of the build, if any
+	Duration float64  `json:"duration"`        // Time the build took, in seconds
+	Outputs  []string `json:"outputs"`         // Files produced, relative to the destination
+}
+
+// writeReport summarizes the outcome of the target builds into a file, as JSON if
+// it has a .json extension, or as plain text lines otherwise. The output files are
+// attributed to the targets they were built for.
+func writeReport(file string, results []targetResult, releases int, outputs []string, names map[string][]string) error {
+	report := &Report{Success: true, Targets: []TargetReport{}}
+	for _, result := range results {
+		entry := TargetReport{
+			Target:   result.Target,
+			Success:  result.Err == nil,
+			Duration: result.Duration.Round(time.Millisecond).Seconds(),
+			Outputs:  []string{},
+		}
+		if releases > 1 {
+			entry.Go = result.Release
+		}
+		if result.Err != nil {
+			entry.Error, report.Success = result.Err.Error(), false
+		}
+		for _, output := range outputs {
+			// Multiple releases are built into subfolders named after them
+			if releases > 1 && !strings.HasPrefix(output, result.Release+"/") {
+				continue
+			}
+			if outputTarget(path.Base(output), []string{result.Target}, names) != "" {
+				entry.Outputs = append(entry.Outputs, output)
+			}
+		}
+		report.Targets = append(report.Targets, entry)
+	}
+	if strings.HasSuffix(file, ".json") {
+		blob, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, append(blob, '\n'), 0644)
+	}
+	text := new(strings.Builder)
+	for _, entry := range report.Targets {
+		status := "PASS"
+		if !entry.Success {
+			status = "FAIL"
+		}
+		target := entry.Target
+		if entry.Go != "" {
+			target = "go" + entry.Go + " " + target
+		}
+		fmt.Fprintf(text, "%s %s (%v)", status, target, time.Duration(entry.Duration*float64(time.Second)).Round(time.Second))
+		switch {
+		case entry.Error != "":
+			fmt.Fprintf(text, ": %s", strings.ReplaceAll(entry.Error, "\n", " "))
+		case len(entry.Outputs) > 0:
+			fmt.Fprintf(text, ": %s", strings.Join(entry.Outputs, ", "))
+		}
+		fmt.Fprintln(text)
+	}
+	return os.WriteFile(file, []byte(text.String()), 0644)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Targets supported by the xgo-build script, in the order it compiles them.
+var supportedTargets = []string{
+	"linux/amd64",
+	"linux/386",
+	"linux/arm-5",
+	"linux/arm-6",
+	"linux/arm-7",
+	"linux/arm64",
+	"linux/mips64",
+	"linux/mips64le",
+	"linux/mips",
+	"linux/mipsle",
+	"linux/ppc64le",
+	"linux/riscv64",
+	"linux/s390x",
+	"windows/amd64",
+	"windows/386",
+	"darwin/amd64",
+	"darwin/arm64",
+	"darwin/386",
+}
+
+// Platforms supporting the build modes restricted by the Go toolchain, with
+// architectures in the build script's notation collapsed to their Go names.
+var buildModePlatforms = map[string][]string{
+	"c-archive": {"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le", "linux/riscv64", "linux/s390x", "darwin/amd64", "darwin/arm64", "windows/386", "windows/amd64"},
+	"c-shared":  {"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le", "linux/riscv64", "linux/s390x", "darwin/amd64", "darwin/arm64", "windows/386", "windows/amd64"},
+	"pie":       {"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le", "linux/riscv64", "linux/s390x", "darwin/amd64", "darwin/arm64", "windows/386", "windows/amd64"},
+	"shared":    {"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le", "linux/s390x"},
+	"plugin":    {"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le", "linux/s390x", "darwin/amd64", "darwin/arm64"},
+}
+
+// Micro-architecture variants of the architectures other than arm, whose variants
+// are distinct targets. They are only built if explicitly requested, forwarded to
+// the build as GO386, GOAMD64 (Go 1.18+), GOMIPS or GOMIPS64.
+var archVariants = map[string][]string{
+	"386":      {"sse2", "softfloat"},
+	"amd64":    {"v1", "v2", "v3", "v4"},
+	"mips":     {"hardfloat", "softfloat"},
+	"mipsle":   {"hardfloat", "softfloat"},
+	"mips64":   {"hardfloat", "softfloat"},
+	"mips64le": {"hardfloat", "softfloat"},
+}
+
+// Platforms whose cross toolchains can link static position independent
+// executables, with architectures collapsed to their Go names.
+var staticPIEPlatforms = []string{"linux/386", "linux/amd64", "linux/arm", "linux/arm64", "linux/ppc64le"}
+
+// Platforms the build script enables the race detector on, with architectures
+// collapsed to their Go names.
+var racePlatforms = []string{"darwin/amd64", "darwin/arm64", "linux/amd64", "windows/amd64"}
+
+// Directive declaring the targets of a repository within its go.mod file.
+const targetsDirective = "//xgo:targets "
+
+// declaredTargets returns the targets a local repository declares to be built
+// for, either listed in a targets.txt file at its root, or in a //xgo:targets
+// comment of its go.mod file. The file they were read from is returned too, or
+// an empty string if the repository declares none.
+func declaredTargets(dir string) ([]string, string, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if module := moduleRoot(root); module != "" {
+		root = module
+	}
+	var declared []string
+	if file := filepath.Join(root, "targets.txt"); fileExists(file) {
+		lines, err := readPackageList(file)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, line := range lines {
+			for _, target := range strings.Split(line, ",") {
+				declared = append(declared, strings.TrimSpace(target))
+			}
+		}
+		return declared, file, nil
+	}
+	file := filepath.Join(root, "go.mod")
+	blob, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for _, line := range strings.Split(string(blob), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, targetsDirective) {
+			declared = append(declared, strings.Split(strings.TrimPrefix(line, targetsDirective), ",")...)
+		}
+	}
+	if len(declared) == 0 {
+		return nil, "", nil
+	}
+	for i := range declared {
+		declared[i] = strings.TrimSpace(declared[i])
+	}
+	return declared, file, nil
+}
+
+// imageTargets returns the targets supported by both the build script and the Go
+// release within an image, as reported by go tool dist list. An empty image asks
+// the Go release of the current system.
+func imageTargets(image string) ([]string, error) {
+	cmd := exec.Command("go", "tool", "dist", "list")
+	if image != "" {
+		args := append(append([]string{"run", "--rm"}, platformArgs()...), "--entrypoint", "go", image, "tool", "dist", "list")
+		cmd = exec.Command(*engine, args...)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", strings.Join(cmd.Args[:2], " "), err)
+	}
+	platforms := strings.Fields(string(out))
+
+	var targets []string
+	for _, target := range supportedTargets {
+		goos, goarch := targetPlatform(target)
+		if contains(platforms, goos+"/"+goarch) {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// buildTargetList expands the requested targets and drops the ones that cannot
+// be built with the requested build flags, warning about each skipped target.
+func buildTargetList(requested []string, flags *BuildFlags) []string {
+	var targets []string
+	for _, target := range expandTargets(requested) {
+		if !supportsBuildMode(target, flags.Mode) {
+			log.Printf("WARNING: Build mode %s not supported on %s, skipping target.", flags.Mode, target)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// supportsBuildMode checks whether a target can be built with a build mode.
+func supportsBuildMode(target string, mode string) bool {
+	platforms, restricted := buildModePlatforms[mode]
+	if !restricted {
+		return true
+	}
+	goos, goarch := targetPlatform(target)
+	for _, platform := range platforms {
+		if platform == goos+"/"+goarch {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsStaticPIE checks whether a target can be built as a static PIE binary.
+func supportsStaticPIE(target string) bool {
+	goos, goarch := targetPlatform(target)
+	return contains(staticPIEPlatforms, goos+"/"+goarch)
+}
+
+// supportsRace checks whether a target can be built with the race detector.
+func supportsRace(target string) bool {
+	goos, goarch := targetPlatform(target)
+	return contains(racePlatforms, goos+"/"+goarch)
+}
+
+// targetPlatform converts a concrete target into its Go OS and architecture,
+// dropping any platform version and architecture variant.
+func targetPlatform(target string) (string, string) {
+	goos, goarch := splitTarget(target)
+	goos, _ = splitPlatform(goos)
+	goarch, _ = splitVariant(goarch)
+	if strings.HasPrefix(goarch, "arm-") {
+		goarch = "arm"
+	}
+	return goos, goarch
+}
+
+// splitVariant splits an architecture into the architecture and its optional
+// micro-architecture variant, e.g. mips-softfloat into mips and softfloat. The
+// arm versions are distinct architectures in the build script, so not split.
+func splitVariant(arch string) (string, string) {
+	parts := strings.SplitN(arch, "-", 2)
+	if _, ok := archVariants[parts[0]]; len(parts) == 1 || (!ok && parts[0] != "*") {
+		return arch, ""
+	}
+	return parts[0], parts[1]
+}
+
+// expandTargets resolves the wildcards of the requested targets against the
+// supported ones, retaining any platform version attached to the OS (e.g.
+// windows-6.0/*). Duplicates are dropped, the order of first match is kept.
+// Entries prefixed with ! exclude all the targets they match from the result,
+// regardless of their position. If only exclusions are requested, they apply
+// to all the supported targets.
+func expandTargets(requested []string) []string {
+	var (
+		expanded []string
+		seen     = make(map[string]bool)
+	)
+	includes, excludes := splitExcludes(requested)
+	if len(includes) == 0 && len(excludes) > 0 {
+		includes = []string{"*/*"}
+	}
+	for _, req := range includes {
+		reqOS, reqArch := splitTarget(req)
+		platform, version := splitPlatform(reqOS)
+		reqArch, variant := splitVariant(reqArch)
+
+		for _, supported := range supportedTargets {
+			goos, goarch := splitTarget(supported)
+			if platform != "*" && platform != goos {
+				continue
+			}
+			// Plain arm is an alias of arm-5 in the build script
+			if reqArch != "*" && reqArch != goarch && !(reqArch == "arm" && goarch == "arm-5") {
+				continue
+			}
+			if variant != "" && !contains(archVariants[goarch], variant) {
+				continue
+			}
+			target := goos
+			if version != "" {
+				target += "-" + version
+			}
+			target += "/" + goarch
+			if variant != "" {
+				target += "-" + variant
+			}
+
+			if !seen[target] && !excluded(target, excludes) {
+				seen[target] = true
+				expanded = append(expanded, target)
+			}
+		}
+	}
+	return expanded
+}
+
+// splitExcludes splits the requested targets into the included and the excluded
+// ones, stripping the ! prefix of the latter. Empty entries are dropped.
+func splitExcludes(requested []string) ([]string, []string) {
+	var includes, excludes []string
+	for _, req := range requested {
+		req = strings.TrimSpace(req)
+		switch {
+		case req == "":
+		case strings.HasPrefix(req, "!"):
+			excludes = append(excludes, strings.TrimSpace(strings.TrimPrefix(req, "!")))
+		default:
+			includes = append(includes, req)
+		}
+	}
+	return includes, excludes
+}
+
+// excluded checks if a target is matched by any of the exclusion patterns.
+func excluded(target string, excludes []string) bool {
+	for _, exclude := range excludes {
+		if matchTarget(exclude, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTargets expands the requested targets into the concrete ones to build
+// with an image, checked against the Go release of the image, the same list
+// -list-targets prints. Targets only matched by wildcards or left after
+// exclusions are dropped if it cannot build them, explicitly requested ones fail.
+func resolveTargets(requested []string, image string) ([]string, error) {
+	expanded := expandTargets(requested)
+	if *dryRun {
+		return expanded, nil
+	}
+	available, err := imageTargets(image)
+	if err == nil && len(available) == 0 {
+		err = errors.New("no known targets reported")
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to list the supported targets, building all requested: %v", err)
+		return expanded, nil
+	}
+	includes, _ := splitExcludes(requested)
+	var explicit []string
+	for _, req := range includes {
+		if goos, goarch := splitTarget(req); !strings.Contains(goos, "*") && goarch != "*" {
+			explicit = append(explicit, expandTargets([]string{req})...)
+		}
+	}
+	var targets []string
+	for _, target := range expanded {
+		goos, goarch := splitTarget(target)
+		goos, _ = splitPlatform(goos)
+		goarch, _ = splitVariant(goarch)
+		switch {
+		case contains(available, goos+"/"+goarch):
+			targets = append(targets, target)
+		case contains(explicit, target):
+			return nil, fmt.Errorf("target %s not supported by the Go release of the image, see -list-targets", target)
+		}
+	}
+	return targets, nil
+}
+
+// splitTarget splits a target into its platform and architecture. A missing
+// architecture is treated as a wildcard. A variant given as a third component,
+// like linux/arm/7, is attached to the architecture as in linux/arm-7.
+func splitTarget(target string) (string, string) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		return parts[0], "*"
+	}
+	return parts[0], strings.Replace(parts[1], "/", "-", 1)
+}
+
+// splitPlatform splits an OS string into the OS and its optional platform
+// version, e.g. darwin-11.3 into darwin and 11.3.
+func splitPlatform(platform string) (string, string) {
+	parts := strings.SplitN(platform, "-", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// validateTargets checks that every requested target refers to a supported
+// platform and architecture, suggesting the closest known ones on a typo.
+func validateTargets(requested []string) error {
+	var platforms, archs []string
+	for _, supported := range supportedTargets {
+		goos, goarch := splitTarget(supported)
+		platforms = appendUnique(platforms, goos)
+		archs = appendUnique(archs, goarch)
+	}
+	archs = appendUnique(archs, "arm")
+
+	for _, req := range requested {
+		req = strings.TrimSpace(req)
+		if req == "" {
+			continue
+		}
+		reqOS, reqArch := splitTarget(strings.TrimPrefix(req, "!"))
+		platform, _ := splitPlatform(reqOS)
+
+		if platform != "*" && !contains(platforms, platform) {
+			return fmt.Errorf("invalid target %s: unknown platform %s, did you mean %s?", req, platform, closest(platform, platforms))
+		}
+		reqArch, variant := splitVariant(reqArch)
+		if reqArch != "*" && !contains(archs, reqArch) {
+			return fmt.Errorf("invalid target %s: unknown architecture %s, did you mean %s?", req, reqArch, closest(reqArch, archs))
+		}
+		if variants := archVariants[reqArch]; variant != "" && reqArch != "*" && !contains(variants, variant) {
+			return fmt.Errorf("invalid target %s: unknown variant %s of %s, did you mean %s?", req, variant, reqArch, closest(variant, variants))
+		}
+		if len(expandTargets([]string{strings.TrimPrefix(req, "!")})) == 0 {
+			return fmt.Errorf("invalid target %s: architecture %s not supported on %s", req, reqArch, platform)
+		}
+	}
+	if len(expandTargets(requested)) == 0 {
+		return fmt.Errorf("no targets left to build, are all of them excluded?")
+	}
+	return nil
+}
+
+// splitScoped splits a value optionally scoped to some targets in the form of
+// os/arch:value into the target pattern and the value. Unscoped values return an
+// empty target pattern.
+func splitScoped(value string) (string, string) {
+	idx := strings.Index(value, ":")
+	if idx <= 0 {
+		return "", value
+	}
+	scope := value[:idx]
+	if !strings.Contains(scope, "/") || strings.HasPrefix(scope, "-") || strings.HasPrefix(scope, "/") || strings.ContainsAny(scope, " \t=") {
+		return "", value
+	}
+	return scope, value[idx+1:]
+}
+
+// validateScoped checks that the target patterns of all scoped values refer to
+// supported targets.
+func validateScoped(values []string) error {
+	for _, value := range values {
+		if scope, _ := splitScoped(value); scope != "" {
+			if err := validateTargets([]string{scope}); err != nil {
+				return fmt.Errorf("%q: %v", value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scopedValues returns the values applying to a target. Values scoped to the
+// target override the unscoped ones, which are used otherwise.
+func scopedValues(values []string, target string) []string {
+	var unscoped, scoped []string
+	for _, value := range values {
+		scope, value := splitScoped(value)
+		switch {
+		case scope == "":
+			unscoped = append(unscoped, value)
+		case matchTarget(scope, target):
+			scoped = append(scoped, value)
+		}
+	}
+	if len(scoped) > 0 {
+		return scoped
+	}
+	return unscoped
+}
+
+// unscopedValues returns the values applying to all targets, dropping the ones
+// scoped to some of them.
+func unscopedValues(values []string) []string {
+	var unscoped []string
+	for _, value := range values {
+		if scope, _ := splitScoped(value); scope == "" {
+			unscoped = append(unscoped, value)
+		}
+	}
+	return unscoped
+}
+
+// matchTarget checks if a target is matched by a target pattern, which may
+// contain wildcards. Platform versions are ignored, and patterns without a
+// variant match all the variants of their architecture too.
+func matchTarget(pattern string, target string) bool {
+	goos, goarch := splitTarget(target)
+	goos, _ = splitPlatform(goos)
+	base, _ := splitVariant(goarch)
+
+	for _, expanded := range expandTargets([]string{pattern}) {
+		expOS, expArch := splitTarget(expanded)
+		if expOS, _ = splitPlatform(expOS); expOS == goos && (expArch == goarch || expArch == base) {
+			return true
+		}
+	}
+	return false
+}
+
+// closest returns the candidates nearest to a word, joined as alternatives for
+// a suggestion. Candidates are ranked by edit distance, ties are broken by the
+// length of the longest substring shared with the word.
+func closest(word string, candidates []string) string {
+	var (
+		best   []string
+		dist   = -1
+		shared = -1
+	)
+	for _, candidate := range candidates {
+		d, c := levenshtein(word, candidate), commonSubstring(word, candidate)
+		switch {
+		case dist < 0 || d < dist || (d == dist && c > shared):
+			best, dist, shared = []string{candidate}, d, c
+		case d == dist && c == shared:
+			best = append(best, candidate)
+		}
+	}
+	return strings.Join(best, " or ")
+}
+
+// commonSubstring returns the length of the longest substring of two strings.
+func commonSubstring(a, b string) int {
+	longest := 0
+	for i := range a {
+		for j := range b {
+			n := 0
+			for i+n < len(a) && j+n < len(b) && a[i+n] == b[j+n] {
+				n++
+			}
+			if n > longest {
+				longest = n
+			}
+		}
+	}
+	return longest
+}
+
+// levenshtein calculates the edit distance between two strings.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smaller of two integers.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// contains checks whether a string is present in a list.
+func contains(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends a string to a list unless already present.
+func appendUnique(list []string, item string) []string {
+	if contains(list, item) {
+		return list
+	}
+	return append(list, item)
+}
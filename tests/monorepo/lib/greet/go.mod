@@ -0,0 +1,3 @@
+module tests/monorepo/lib/greet
+
+go 1.17
@@ -0,0 +1,8 @@
+package greet
+
+import "fmt"
+
+// Hello greets from a module outside of the one being built.
+func Hello() {
+	fmt.Println("Hello from the monorepo!")
+}
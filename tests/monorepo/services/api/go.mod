@@ -0,0 +1,7 @@
+module tests/monorepo/services/api
+
+go 1.17
+
+require tests/monorepo/lib/greet v0.0.0
+
+replace tests/monorepo/lib/greet => ../../lib/greet
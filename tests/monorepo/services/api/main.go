@@ -0,0 +1,7 @@
+package main
+
+import "tests/monorepo/lib/greet"
+
+func main() {
+	greet.Hello()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// universalTarget is the pseudo target the merged universal darwin binaries are
+// attributed to in the manifest and the archives.
+const universalTarget = "darwin/universal"
+
+// universalScript merges every triplet of universal output, amd64 and arm64 slice
+// passed as arguments. The lipo of osxcross is prefixed with the darwin release
+// it targets, so it is looked up by pattern if not available as is.
+const universalScript = `lipo=$(command -v lipo || ls /osxcross/bin/*-lipo | head -n 1)
+while [ $# -gt 0 ]; do
+  "$lipo" -create -output "$1" "$2" "$3" || exit 1
+  shift 3
+done`
+
+// universalSlices returns the darwin amd64 and arm64 targets to merge into the
+// universal binaries, or empty strings for those not requested.
+func universalSlices(targets []string) (string, string) {
+	var amd64, arm64 string
+	for _, target := range expandTargets(targets) {
+		goos, goarch := splitTarget(target)
+		if goos, _ = splitPlatform(goos); goos != "darwin" {
+			continue
+		}
+		switch goarch {
+		case "amd64":
+			amd64 = target
+		case "arm64":
+			arm64 = target
+		}
+	}
+	return amd64, arm64
+}
+
+// universalOutputs pairs the darwin amd64 outputs in a folder with their arm64
+// counterparts, returning the universal output, amd64 and arm64 slice of each,
+// relative to the folder. The outputs of module builds are nested into folders
+// of their module path, so the folder is searched recursively and the universal
+// binaries are placed next to their slices. Headers of C libraries are shared by
+// the slices, and outputs moved into <os>/<arch> folders by a nested layout were
+// merged already, so both are left alone.
+func universalOutputs(folder string, config *ConfigFlags, amd64 string, arm64 string) ([][3]string, error) {
+	names, err := outputNames(config, []string{amd64, arm64, universalTarget})
+	if err != nil {
+		return nil, err
+	}
+	existing, err := snapshotOutputs(folder)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for file := range existing {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var outputs [][3]string
+	for _, file := range files {
+		dir, name := path.Split(file)
+		if strings.HasSuffix(name, ".h") || strings.HasSuffix("/"+dir, "/darwin/amd64/") || outputTarget(name, []string{amd64}, names) == "" {
+			continue
+		}
+		var slice, merged string
+		if templates, ok := names[amd64]; ok {
+			for i, templated := range templates {
+				if name == templated || strings.HasPrefix(name, templated+".") {
+					ext := strings.TrimPrefix(name, templated)
+					slice, merged = names[arm64][i]+ext, names[universalTarget][i]+ext
+				}
+			}
+		} else {
+			idx := strings.LastIndex(name, "-darwin-amd64")
+			slice = name[:idx] + "-darwin-arm64" + name[idx+len("-darwin-amd64"):]
+			merged = name[:idx] + "-darwin-universal" + name[idx+len("-darwin-amd64"):]
+		}
+		slice, merged = dir+slice, dir+merged
+		if _, ok := existing[slice]; !ok {
+			return nil, fmt.Errorf("%s slice %s of %s not found", arm64, slice, file)
+		}
+		outputs = append(outputs, [3]string{merged, file, slice})
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no %s outputs found to merge", amd64)
+	}
+	return outputs, nil
+}
+
+// mergeUniversal merges the darwin amd64 and arm64 outputs in a folder into
+// universal binaries with lipo, running it within the given image, or on the
+// current system if no image is given.
+func mergeUniversal(ctx context.Context, image string, config *ConfigFlags, folder string) error {
+	amd64, arm64 := universalSlices(config.Targets)
+	outputs, err := universalOutputs(folder, config, amd64, arm64)
+	if err != nil {
+		return err
+	}
+	root := "/build"
+	if image == "" {
+		root = folder
+	}
+	var files []string
+	for _, output := range outputs {
+		log.Printf("INFO: Merging %s and %s into %s...", output[1], output[2], output[0])
+		for _, file := range output {
+			files = append(files, root+"/"+filepath.ToSlash(file))
+		}
+	}
+	cmd := exec.CommandContext(ctx, "bash", append([]string{"-c", universalScript, "lipo"}, files...)...)
+	if image != "" {
+		args := append([]string{"run", "--rm", "-v", folder + ":/build"}, platformArgs()...)
+		args = append(args, userArgs(false)...)
+		args = append(args, []string{"--entrypoint", "/bin/bash", image, "-c", universalScript, "lipo"}...)
+		cmd = exec.CommandContext(ctx, *engine, append(args, files...)...)
+	}
+	return run(cmd)
+}
@@ -2,6 +2,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"go/build"
@@ -10,9 +15,17 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 var version = "dev"
@@ -25,40 +38,121 @@ var dockerDist = "ghcr.io/crazy-max/xgo"
 var (
 	goVersion   = flag.String("go", "latest", "Go release to use for cross compilation")
 	goProxy     = flag.String("goproxy", "", "Set a Global Proxy for Go Modules")
+	netrcFile   = flag.String("netrc", "", "Credentials file to authenticate git and the module proxy with in the build, instead of ~/.netrc (empty = none)")
 	srcPackage  = flag.String("pkg", "", "Sub-package to build if not root import")
+	moduleDir   = flag.String("module-dir", "", "Folder of the Go module within the repository, for monorepos with modules in subfolders (empty = root)")
+	pkgsFile    = flag.String("packages-file", "", "File listing further packages to build, one per line (- = stdin, empty = none)")
+	sinceRef    = flag.String("since", "", "Only build the packages of a local repository changed since the given git revision (empty = all)")
 	srcRemote   = flag.String("remote", "", "Version control remote repository to build")
 	srcBranch   = flag.String("branch", "", "Version control branch to build")
-	outPrefix   = flag.String("out", "", "Prefix to use for output naming (empty = package name)")
+	srcRevision = flag.String("rev", "", "Version control tag or commit to build, taking precedence over the branch")
+	outPrefix   = flag.String("out", "", "Prefix to use for output naming, or comma separated pkg=prefix mappings of multiple packages (empty = package name, - = stream the single output to stdout)")
+	outTemplate = flag.String("out-template", "", "Template for output naming with {{.OS}}, {{.Arch}}, {{.Version}} and {{.Package}} (empty = prefix naming)")
 	outFolder   = flag.String("dest", "", "Destination folder to put binaries in (empty = current)")
-	crossDeps   = flag.String("deps", "", "CGO dependencies (configure/make based archives)")
-	crossArgs   = flag.String("depsargs", "", "CGO dependency configure arguments")
+	buildCache  = flag.String("cache", "", "Folder to persist the Go build cache in across builds (empty = none)")
+	buildScript = flag.String("build-script", "", "Custom script to run in the build container instead of xgo-build, with the same environment (empty = default)")
+	winRes      = flag.String("winres", "", "Windows resource script (.rc) to embed into windows outputs (empty = none)")
+	crossDeps   = flag.String("deps", "", "CGO dependencies (configure/make based archives, or git+<url>[#<ref>] repositories)")
+	crossArgs   = stringsFlagVar("depsargs", "CGO dependency configure arguments, optionally scoped to one as archive:args (repeatable)")
+	depsBuilt   = flag.String("deps-cache", "", "Folder to persist the built CGO dependencies in across builds (empty = none)")
 	targets     = flag.String("targets", "*/*", "Comma separated targets to build for")
+	targetOS    = flag.String("goos", "", "Operating system of a single target to build for instead of -targets, along with -goarch")
+	targetArch  = flag.String("goarch", "", "Architecture of a single target to build for instead of -targets, along with -goos")
+	parallelism = flag.Int("p", runtime.NumCPU(), "Number of targets to build in parallel")
+	memoryLimit = flag.String("memory", "", "Memory limit of each build container, e.g. 2g (empty = unlimited)")
+	cpuLimit    = flag.String("cpus", "", "Number of CPUs each build container may use, e.g. 1.5 (empty = unlimited)")
+	reportFile  = flag.String("report", "", "File to write the outcome of every target build into, as JSON with a .json extension or text otherwise (empty = none)")
+	manifest    = flag.String("manifest", "", "JSON file to describe the produced artifacts in (empty = none)")
+	labels      = stringsFlagVar("label", "Label to attach to every artifact in the manifest as KEY=VAL (repeatable)")
+	checksums   = flag.Bool("checksums", false, "Write a SHA256SUMS file covering the produced artifacts into the destination folder")
+	fileMode    = flag.String("chmod", "", "Permissions to set on every produced output once built, in octal, e.g. 0755 (empty = as built)")
+	maxSize     = flag.String("max-output-size", "", "Maximum size of every produced output, in bytes or with a unit like 50m or 1g (empty = unlimited)")
+	postBuild   = flag.String("post-build", "", "Command to run on every produced output once built, with {} replaced by its path (empty = none)")
+	layout      = flag.String("layout", layoutFlat, "Layout of the outputs in the destination folder: flat, or nested into <os>/<arch> subfolders")
+	universal   = flag.Bool("universal", false, "Merge the darwin/amd64 and darwin/arm64 outputs into *-darwin-universal binaries with lipo")
+	archive     = flag.String("package", "", "Package each target's artifacts into an archive: auto (zip for windows, tar.gz otherwise), tar.gz or zip (empty = none)")
+	bundle      = flag.String("package-files", "", "Comma separated extra files to bundle into every archive, e.g. LICENSE,README.md")
 	dockerRepo  = flag.String("docker-repo", "", "Use custom docker repo instead of official distribution")
 	dockerImage = flag.String("docker-image", "", "Use custom docker image instead of official distribution")
+	imageDigest = flag.String("docker-digest", "", "Pin the official or custom repo image to a digest, e.g. sha256:... (empty = tag only)")
+	dockerPlat  = flag.String("builder-platform", "", "Platform of the builder image to run, e.g. linux/amd64 (empty = autodetect)")
+	dockerUser  = flag.String("user", "auto", "User to run the build containers as, as uid[:gid] (auto = the host user on Linux with docker for module builds without CGO dependencies, empty = image default)")
+	imagePull   = flag.String("pull", "missing", "Image pull policy (never, missing, always)")
+	pullRetries = flag.Int("pull-retries", 3, "Number of times to retry image pulls failing with transient errors")
+	pullLogin   = flag.Bool("registry-auth", false, "Log into the image registry with $XGO_REGISTRY_USER and $XGO_REGISTRY_PASSWORD before pulling")
+	engine      = flag.String("engine", "", "Container engine to run the builds with (docker, podman, empty = autodetect)")
+	skipCheck   = flag.Bool("skip-docker-check", false, "Skip verifying the container engine works before building (failures surface later and less clearly)")
+	printImage  = flag.Bool("print-image", false, "Print the image the builds would run in for each requested Go release and exit")
+	listTargets = flag.Bool("list-targets", false, "List the targets supported by the selected image and exit")
+	prune       = flag.Bool("prune", false, "Remove the locally cached images of the official or -docker-repo repository but the latest -prune-keep ones, then exit")
+	pruneKeep   = flag.Int("prune-keep", 1, "Number of the latest images to keep when pruning")
+	pruneAge    = flag.Duration("prune-older-than", 0, "Only prune the images created longer ago than this, e.g. 720h (0 = any age)")
+	assumeYes   = flag.Bool("yes", false, "Prune the images without asking for confirmation")
+	quiet       = flag.Bool("quiet", false, "Suppress all output but errors")
+	logJSON     = flag.Bool("log-json", false, "Emit log messages as JSON lines")
+	dryRun      = flag.Bool("dry-run", false, "Print the docker commands instead of executing them")
+	showVersion = flag.Bool("version", false, "Print the version of xgo and the image it builds with by default, then exit")
+	completion  = flag.String("completion", "", "Print a shell completion script for bash, zsh or fish and exit")
+	shell       = flag.Bool("shell", false, "Open an interactive shell in the build container of the requested target instead of building")
+	isolated    = flag.Bool("isolate-gopath", false, "Mount a fresh GOPATH of this run into the builds instead of the host one, removed once done")
+	offline     = flag.Bool("offline", false, "Build without any network access, from local sources, cached dependencies and the warm module cache only")
+	network     = flag.String("network", "", "Docker network to attach the build containers to, e.g. to reach internal hosts only resolvable on it (empty = default)")
+	noCleanup   = flag.Bool("no-cleanup", false, "Keep the build containers once done, named xgo-<os>-<arch>, for inspection instead of removing them")
+	timeout     = flag.Duration("timeout", 0, "Maximum duration of the cross compilation (0 = unlimited)")
+	failFast    = flag.Bool("fail-fast", false, "Abort the remaining builds, including those of other Go releases, on the first target failure")
+	strict      = flag.Bool("strict", false, "Fail the targets whose build succeeds without producing any output or can't honor -race")
+	clean       = flag.Bool("clean", false, "Remove stale outputs of previous builds from the destination folder before building")
+	minSpace    = flag.Int("min-space", 5, "Free disk space in GiB to warn below before building (0 = no check)")
+	failOnSpace = flag.Bool("fail-on-low-space", false, "Fail instead of warning if free disk space is below -min-space")
+	extraEnv    = stringsFlagVar("env", "Extra environment variable to set for the build as KEY=VAL (repeatable)")
+	dockerOpts  = stringsFlagVar("docker-opt", "Extra option to pass verbatim to docker run, e.g. \"--network host\" (repeatable, use with care)")
+	targetVars  = stringsFlagVar("target-env", "Extra environment variable to set for the builds of matching targets as os/arch:KEY=VAL (repeatable)")
 )
 
+// Go environment variables forwarded from the host into the build container
+var forwardedEnv = []string{"GOPROXY", "GONOPROXY", "GOSUMDB", "GONOSUMDB", "GONOSUMCHECK", "GOPRIVATE", "GOINSECURE", "GOFLAGS"}
+
 // ConfigFlags is a simple set of flags to define the environment and dependencies.
 type ConfigFlags struct {
 	Repository   string   // Root import path to build
 	Package      string   // Sub-package to build if not root import
+	ModuleDir    string   // Folder of the Go module within the repository
 	Prefix       string   // Prefix to use for output naming
 	Remote       string   // Version control remote repository to build
 	Branch       string   // Version control branch to build
+	Revision     string   // Version control tag or commit to build
+	ModVersion   string   // Published module version to build from the module proxy
 	Dependencies string   // CGO dependencies (configure/make based archives)
 	Arguments    string   // CGO dependency configure arguments
+	DepArguments []string // CGO dependency configure arguments of single dependencies
 	Targets      []string // Targets to build for
+	Version      string   // Version of the sources being built
 }
 
 // Command line arguments to pass to go build
 var (
 	buildVerbose  = flag.Bool("v", false, "Print the names of packages as they are compiled")
 	buildSteps    = flag.Bool("x", false, "Print the command as executing the builds")
-	buildRace     = flag.Bool("race", false, "Enable data race detection (supported only on amd64)")
+	buildRace     = flag.Bool("race", false, "Enable data race detection (supported only on amd64 and darwin/arm64)")
 	buildTags     = flag.String("tags", "", "List of build tags to consider satisfied during the build")
-	buildLdFlags  = flag.String("ldflags", "", "Arguments to pass on each go tool link invocation")
+	buildLdFlags  = stringsFlagVar("ldflags", "Arguments to pass on each go tool link invocation, optionally scoped as os/arch:flags appended to the unscoped ones (repeatable)")
 	buildMode     = flag.String("buildmode", "default", "Indicates which kind of object file to build")
-	buildVCS      = flag.String("buildvcs", "", "Whether to stamp binaries with version control information")
+	buildVCS      = flag.String("buildvcs", "", "Whether to stamp binaries with version control information: auto, true (mounting the git work tree of local modules) or false (empty = Go default)")
 	buildTrimPath = flag.Bool("trimpath", false, "Remove all file system paths from the resulting executable")
+	buildStatic   = flag.Bool("static-pie", false, "Build statically linked position independent executables where supported")
+	buildStamp    = flag.Bool("stamp", false, "Inject the version, commit and build date of the sources into the binaries")
+	stampVars     = flag.String("stamp-vars", "main.version,main.commit,main.date", "Variables to inject the version, commit and build date into, in this order")
+	buildDebug    = flag.Bool("debug", false, "Build debuggable binaries, never stripping their symbol table and DWARF information")
+	buildRelease  = flag.Bool("release", false, "Build release binaries, stripping their symbol table and DWARF information (-ldflags \"-s -w\")")
+	buildSplit    = flag.Bool("split-debug", false, "Strip the debug symbols of ELF binaries into separate .debug files next to them, with objcopy")
+	buildCover    = flag.Bool("cover", false, "Instrument the binaries for coverage, written into $GOCOVERDIR at runtime (Go 1.20+)")
+	buildTests    = flag.Bool("build-tests", false, "Compile test binaries of the package instead of the package itself")
+	buildVet      = flag.Bool("vet", false, "Run go vet on the packages for every target instead of building them, producing no outputs")
+	cgoCFlags     = stringsFlagVar("cgo-cflags", "Extra CGO_CFLAGS for the build, optionally scoped as os/arch:flags (repeatable)")
+	cgoLdFlags    = stringsFlagVar("cgo-ldflags", "Extra CGO_LDFLAGS for the build, optionally scoped as os/arch:flags (repeatable)")
+	cCompiler     = stringsFlagVar("cc", "C compiler of the image to use instead of the default, optionally scoped as os/arch:compiler (repeatable)")
+	cxxCompiler   = stringsFlagVar("cxx", "C++ compiler of the image to use instead of the default, optionally scoped as os/arch:compiler (repeatable)")
+	cgoMode       = stringsFlagVar("cgo", "Whether to enable cgo (true, false, auto), optionally scoped as os/arch:value (repeatable)")
 )
 
 // BuildFlags is a simple collection of flags to fine tune a build.
@@ -71,50 +165,412 @@ type BuildFlags struct {
 	Mode     string // Indicates which kind of object file to build
 	VCS      string // Whether to stamp binaries with version control information
 	TrimPath bool   // Remove all file system paths from the resulting executable
+	Static   bool   // Build statically linked position independent executables
+	Debug    bool   // Keep the symbol table and DWARF information of the binaries
+	Split    bool   // Strip the debug symbols of ELF binaries into separate files
+	Cover    bool   // Instrument the binaries for coverage
+	Tests    bool   // Compile test binaries of the package instead of the package itself
+	Vet      bool   // Vet the packages for every target instead of building them
 }
 
 func main() {
 	log.SetFlags(0)
 	defer log.Println("INFO: Completed!")
-	log.Printf("INFO: Starting xgo/%s", version)
 
-	// Retrieve the CLI flags and the execution environment
+	// Retrieve the CLI flags and the execution environment, filling in any settings
+	// not given explicitly from the project configuration
+	flag.Usage = usage
 	flag.Parse()
 
+	// Version reports need to work even without a container engine, so go first
+	if *showVersion {
+		fmt.Printf("xgo version %s %s/%s\n", version, runtime.GOOS, runtime.GOARCH)
+		fmt.Printf("default image %s:%s\n", dockerDist, flag.Lookup("go").DefValue)
+		return
+	}
+	// Shell completion only introspects the flags, nothing else to set up
+	if *completion != "" {
+		script, err := completionScript(*completion)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to generate completion script: %v.", err)
+		}
+		fmt.Print(script)
+		return
+	}
+	project, err := loadProjectConfig()
+
+	log.SetOutput(newLogWriter(os.Stderr))
+	log.Printf("INFO: Starting xgo/%s", version)
+
+	if err != nil {
+		log.Fatalf("ERROR: Failed to load project configuration: %v.", err)
+	} else if project != "" {
+		log.Printf("INFO: Using project configuration from %s", project)
+	}
+
+	// Local repositories may declare the targets to build unless overridden, either
+	// on the command line, even if with the default value, or by the project
+	explicitTargets := false
+	flag.Visit(func(f *flag.Flag) { explicitTargets = explicitTargets || f.Name == "targets" })
+	if args := flag.Args(); len(args) > 0 && isLocal(args[0]) && !explicitTargets && *targets == flag.Lookup("targets").DefValue && *targetOS == "" && *targetArch == "" {
+		declared, file, err := declaredTargets(args[0])
+		if err != nil {
+			log.Fatalf("ERROR: Failed to read declared build targets: %v.", err)
+		}
+		if file != "" {
+			log.Printf("INFO: Using build targets declared in %s", file)
+			*targets = strings.Join(declared, ",")
+		}
+	}
+	// A single target may be given the way the go tool takes it too
+	if *targetOS != "" || *targetArch != "" {
+		switch {
+		case explicitTargets:
+			log.Fatalf("ERROR: -goos and -goarch cannot be combined with -targets.")
+		case *targetOS == "" || *targetArch == "":
+			log.Fatalf("ERROR: -goos and -goarch must be set together.")
+		case strings.ContainsAny(*targetOS+*targetArch, "/,!*"):
+			log.Fatalf("ERROR: -goos and -goarch take a single operating system and architecture, use -targets for more.")
+		}
+		*targets = *targetOS + "/" + *targetArch
+	}
+	if err := validateTargets(strings.Split(*targets, ",")); err != nil {
+		log.Fatalf("ERROR: Failed to validate build targets: %v", err)
+	}
+	if *layout != layoutFlat && *layout != layoutNested {
+		log.Fatalf("ERROR: Invalid output layout %q, must be flat or nested.", *layout)
+	}
+	if *universal {
+		if amd64, arm64 := universalSlices(strings.Split(*targets, ",")); amd64 == "" || arm64 == "" {
+			log.Fatalf("ERROR: Universal darwin binaries require both darwin/amd64 and darwin/arm64 targets.")
+		}
+	}
+	// Vetting produces no outputs, so nothing is left to post-process
+	if *buildVet {
+		switch {
+		case *buildTests:
+			log.Fatalf("ERROR: Vetting the packages cannot be combined with building test binaries.")
+		case *buildSplit, *universal, *archive != "", *postBuild != "", *strict, *outPrefix == "-":
+			log.Fatalf("ERROR: Vetting the packages produces no outputs to post-process, or check with -strict.")
+		}
+	}
+	if *buildTests && *buildMode != "default" && *buildMode != "exe" {
+		log.Fatalf("ERROR: Test binaries cannot be built with build mode %s.", *buildMode)
+	}
+	if *buildStatic && *buildMode != "default" && *buildMode != "pie" {
+		log.Fatalf("ERROR: Static PIE binaries cannot be built with build mode %s.", *buildMode)
+	}
+	if *buildStatic && strings.Contains(strings.Join(*buildLdFlags, " "), "-extldflags") {
+		log.Fatalf("ERROR: Static PIE binaries cannot be built with custom -extldflags.")
+	}
+	if *buildVCS != "" && *buildVCS != "auto" && *buildVCS != "true" && *buildVCS != "false" {
+		log.Fatalf("ERROR: Invalid VCS stamping mode %q, must be one of auto, true or false.", *buildVCS)
+	}
+	if *buildDebug && *buildRelease {
+		log.Fatalf("ERROR: Debug and release builds are mutually exclusive.")
+	}
+	if *buildSplit && (*buildDebug || *buildRelease) {
+		log.Fatalf("ERROR: Splitting debug symbols is mutually exclusive with debug and release builds.")
+	}
+	if *buildSplit && (*buildMode == "archive" || *buildMode == "c-archive") {
+		log.Fatalf("ERROR: Debug symbols cannot be split from build mode %s.", *buildMode)
+	}
+	if *buildDebug || *buildSplit {
+		for _, value := range *buildLdFlags {
+			_, value = splitScoped(value)
+			for _, ldflag := range strings.Fields(value) {
+				if ldflag == "-s" || ldflag == "-w" {
+					log.Fatalf("ERROR: Debug symbols cannot be kept with -ldflags %s.", ldflag)
+				}
+			}
+		}
+	}
+	if *winRes != "" && !fileExists(*winRes) {
+		log.Fatalf("ERROR: Windows resource script %s not found.", *winRes)
+	}
+	for _, opt := range *dockerOpts {
+		if !strings.HasPrefix(strings.TrimSpace(opt), "-") {
+			log.Fatalf("ERROR: Invalid docker option %q, must start with a dash.", opt)
+		}
+	}
+	if err := validateLimits(*memoryLimit, *cpuLimit); err != nil {
+		log.Fatalf("ERROR: Invalid container resource limit: %v.", err)
+	}
+	if *netrcFile != "" && !fileExists(*netrcFile) {
+		log.Fatalf("ERROR: Credentials file %s not found.", *netrcFile)
+	}
+	if *moduleDir != "" {
+		if clean := filepath.ToSlash(filepath.Clean(*moduleDir)); filepath.IsAbs(*moduleDir) || clean == ".." || strings.HasPrefix(clean, "../") {
+			log.Fatalf("ERROR: Module folder %s must be relative to and within the repository.", *moduleDir)
+		}
+		*moduleDir = filepath.ToSlash(filepath.Clean(*moduleDir))
+	}
+	if *buildScript != "" && !fileExists(*buildScript) {
+		log.Fatalf("ERROR: Build script %s not found.", *buildScript)
+	}
+	if err := validateScoped(append(append(append(append(append([]string{}, *cgoCFlags...), *cgoLdFlags...), *cCompiler...), *cxxCompiler...), *buildLdFlags...)); err != nil {
+		log.Fatalf("ERROR: Failed to validate CGO flags: %v", err)
+	}
+	if err := validateCgoMode(*cgoMode); err != nil {
+		log.Fatalf("ERROR: Failed to validate cgo mode: %v", err)
+	}
+	if *outTemplate != "" {
+		if _, err := template.New("out").Parse(*outTemplate); err != nil {
+			log.Fatalf("ERROR: Failed to parse output name template: %v.", err)
+		}
+	}
+	for _, env := range *extraEnv {
+		if !strings.Contains(env, "=") || strings.HasPrefix(env, "=") {
+			log.Fatalf("ERROR: Invalid environment variable %q, must be KEY=VAL.", env)
+		}
+	}
+	artifactLabels := make(map[string]string)
+	for _, label := range *labels {
+		idx := strings.Index(label, "=")
+		if idx <= 0 {
+			log.Fatalf("ERROR: Invalid artifact label %q, must be KEY=VAL.", label)
+		}
+		artifactLabels[label[:idx]] = label[idx+1:]
+	}
+	if len(artifactLabels) > 0 && *manifest == "" {
+		log.Fatalf("ERROR: Artifact labels are recorded in the manifest, which requires -manifest.")
+	}
+	for _, env := range *targetVars {
+		scope, value := splitScoped(env)
+		if scope == "" || !strings.Contains(value, "=") || strings.HasPrefix(value, "=") {
+			log.Fatalf("ERROR: Invalid target environment variable %q, must be os/arch:KEY=VAL.", env)
+		}
+	}
+	if err := validateScoped(*targetVars); err != nil {
+		log.Fatalf("ERROR: Failed to validate target environment variables: %v", err)
+	}
+	var mode os.FileMode
+	if *fileMode != "" {
+		perm, err := strconv.ParseUint(*fileMode, 8, 32)
+		if err != nil || perm > 0777 {
+			log.Fatalf("ERROR: Invalid output permissions %q, must be octal between 0000 and 0777.", *fileMode)
+		}
+		mode = os.FileMode(perm)
+	}
+	var sizeLimit int64
+	if *maxSize != "" {
+		limit, err := parseSize(*maxSize)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid maximum output size %q: %v.", *maxSize, err)
+		}
+		sizeLimit = limit
+	}
+	var extras []string
+	for _, file := range strings.Split(*bundle, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			extras = append(extras, file)
+		}
+	}
+	if len(extras) > 0 && *archive == "" {
+		log.Fatalf("ERROR: Bundled files require packaging the artifacts with -package.")
+	}
+	if err := validateArchive(*archive, extras); err != nil {
+		log.Fatalf("ERROR: Failed to prepare artifact packaging: %v.", err)
+	}
+	// Streaming the output keeps stdout clean for the binary, everything else goes to stderr
+	stdout, stream := os.Stdout, *outPrefix == "-"
+	if stream {
+		switch {
+		case len(expandTargets(strings.Split(*targets, ","))) != 1:
+			log.Fatalf("ERROR: Streaming the output to stdout requires a single target.")
+		case *archive != "" || *checksums || *universal || *layout != layoutFlat:
+			log.Fatalf("ERROR: Streaming the output to stdout cannot be combined with packaging, checksums or nested layouts.")
+		}
+		*outPrefix, os.Stdout = "", os.Stderr
+	}
+
+	// Packages may be listed in a file too, in addition to the arguments
+	packageArgs := flag.Args()
+	if *pkgsFile != "" {
+		listed, err := readPackageList(*pkgsFile)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to read package list: %v.", err)
+		}
+		if len(listed) == 0 {
+			log.Fatalf("ERROR: No packages listed in %s.", *pkgsFile)
+		}
+		packageArgs = append(packageArgs, listed...)
+	}
+	// Published module versions are built like go install, from the module proxy
+	var modVersion string
+	for i, arg := range packageArgs {
+		idx := strings.LastIndex(arg, "@")
+		if idx < 0 {
+			continue
+		}
+		switch {
+		case len(packageArgs) > 1:
+			log.Fatalf("ERROR: Module versions can only be built for a single import path.")
+		case isLocal(arg) || idx == 0 || idx == len(arg)-1:
+			log.Fatalf("ERROR: Invalid module version %q, must be <import path>@<version>.", arg)
+		case *srcRemote != "" || *srcBranch != "" || *srcRevision != "" || *moduleDir != "":
+			log.Fatalf("ERROR: Module versions cannot be combined with -remote, -branch, -rev or -module-dir.")
+		}
+		packageArgs[i], modVersion = arg[:idx], arg[idx+1:]
+	}
 	xgoInXgo := os.Getenv("XGO_IN_XGO") == "1"
 	if xgoInXgo {
 		depsCache = "/deps-cache"
 	}
+	// Multiple Go releases may be requested to verify the build against each
+	var versions []string
+	for _, version := range strings.Split(*goVersion, ",") {
+		if strings.TrimSpace(version) == "" {
+			continue
+		}
+		normalized, err := normalizeGoVersion(version)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid Go release %q: %v.", version, err)
+		}
+		versions = append(versions, normalized)
+	}
+	if len(versions) == 0 {
+		log.Fatalf("ERROR: No Go release requested.")
+	}
+	// GOAMD64 levels are only known to Go 1.18 and later, older ones would skip them
+	for _, target := range expandTargets(strings.Split(*targets, ",")) {
+		if _, goarch := splitTarget(target); strings.HasPrefix(goarch, "amd64-") {
+			for _, version := range versions {
+				if goReleaseBefore(version, 18) {
+					log.Fatalf("ERROR: Target %s requires Go 1.18 or later for GOAMD64, not %s.", target, version)
+				}
+			}
+		}
+	}
+	*goVersion = strings.Join(versions, ",")
+	if len(versions) > 1 && (xgoInXgo || *dockerImage != "") {
+		log.Fatalf("ERROR: Multiple Go releases can only be built with the official or a custom repository image.")
+	}
+	if stream && len(versions) > 1 {
+		log.Fatalf("ERROR: Streaming the output to stdout requires a single Go release.")
+	}
+	if *shell && (xgoInXgo || len(versions) > 1) {
+		log.Fatalf("ERROR: Debug shell requires a container build with a single Go release.")
+	}
+	if *noCleanup && (xgoInXgo || len(versions) > 1) {
+		log.Fatalf("ERROR: Keeping build containers requires a container build with a single Go release.")
+	}
+	if *imageDigest != "" {
+		if err := validateDigest(*imageDigest); err != nil {
+			log.Fatalf("ERROR: Invalid image digest %q: %v.", *imageDigest, err)
+		}
+		switch {
+		case len(versions) > 1:
+			log.Fatalf("ERROR: Image digest cannot pin multiple Go releases.")
+		case strings.Contains(*dockerImage, "@"):
+			log.Fatalf("ERROR: Image digest cannot be combined with a custom image already pinned by digest.")
+		}
+	}
+	// Image names are resolved from the flags alone, no container engine needed
+	if *printImage {
+		if xgoInXgo {
+			log.Fatalf("ERROR: No image is used to build within the xgo image.")
+		}
+		for _, version := range versions {
+			fmt.Println(imageName(version))
+		}
+		return
+	}
 	// Only use docker images if we're not already inside out own image
-	image := ""
+	images := make([]string, len(versions))
 
 	if !xgoInXgo {
-		// Ensure docker is available
-		if err := checkDocker(); err != nil {
-			log.Fatalf("ERROR: Failed to check docker installation: %v.", err)
+		// Pick the container engine, preferring docker if both are installed
+		switch *engine {
+		case "":
+			*engine = "docker"
+			if _, err := exec.LookPath("docker"); err != nil {
+				if _, err := exec.LookPath("podman"); err == nil {
+					*engine = "podman"
+				}
+			}
+			log.Printf("INFO: Using %s container engine", *engine)
+		case "docker", "podman":
+		default:
+			log.Fatalf("ERROR: Invalid container engine %q, must be docker or podman.", *engine)
+		}
+		// Ensure docker is available, unless the environment already vouched for it
+		if !*skipCheck {
+			if err := checkDocker(); err != nil {
+				log.Fatalf("ERROR: Failed to check docker installation: %v.", err)
+			}
+		}
+		// Pruning the cached images needs neither packages nor the build images
+		if *prune {
+			repository := dockerDist
+			if *dockerRepo != "" {
+				repository = *dockerRepo
+			}
+			if *pruneKeep < 0 {
+				log.Fatalf("ERROR: Invalid number of images to keep %d, must not be negative.", *pruneKeep)
+			}
+			if err := pruneImages(repository, *pruneKeep, *pruneAge, *assumeYes); err != nil {
+				log.Fatalf("ERROR: Failed to prune %s images: %v.", repository, err)
+			}
+			return
 		}
 		// Validate the command line arguments
-		if len(flag.Args()) != 1 {
-			log.Fatalf("Usage: %s [options] <go import path>", os.Args[0])
-		}
-		// Select the image to use, either official or custom
-		image = fmt.Sprintf("%s:%s", dockerDist, *goVersion)
-		if *dockerImage != "" {
-			image = *dockerImage
-		} else if *dockerRepo != "" {
-			image = fmt.Sprintf("%s:%s", *dockerRepo, *goVersion)
-		}
-		// Check that all required images are available
-		found := checkDockerImage(image)
-		switch {
-		case !found:
-			fmt.Println("not found!")
-			if err := pullDockerImage(image); err != nil {
-				log.Fatalf("ERROR: Failed to pull docker image from the registry: %v.", err)
+		if len(packageArgs) == 0 && !*listTargets {
+			log.Fatalf("Usage: %s [options] <go import path>...", os.Args[0])
+		}
+		if *imagePull != "never" && *imagePull != "missing" && *imagePull != "always" {
+			log.Fatalf("ERROR: Invalid image pull policy %q, must be one of never, missing or always.", *imagePull)
+		}
+		// Offline builds may only use what is already on this machine
+		if *offline {
+			switch {
+			case *imagePull == "always":
+				log.Fatalf("ERROR: Images can't be pulled with -offline, use -pull missing or never.")
+			case *goProxy != "":
+				log.Fatalf("ERROR: A module proxy can't be used with -offline.")
+			case *isolated:
+				log.Fatalf("ERROR: An isolated GOPATH has no module cache to build with -offline.")
+			case *srcRemote != "":
+				log.Fatalf("ERROR: Remote repositories can't be fetched with -offline.")
+			}
+			*imagePull = "never"
+		}
+		// Builds attached to a missing network would all fail to start
+		if *network != "" {
+			if *offline {
+				log.Fatalf("ERROR: Builds can't be attached to network %s with -offline.", *network)
+			}
+			if !*dryRun {
+				if err := checkNetwork(*network); err != nil {
+					log.Fatalf("ERROR: Failed to check docker network %s: %v.", *network, err)
+				}
+			}
+		}
+		for i, version := range versions {
+			images[i] = imageName(version)
+			// Check that all required images are available, pulling as the policy allows
+			if err := ensureDockerImage(images[i]); err != nil {
+				log.Fatalf("ERROR: Failed to prepare docker image %s: %v.", images[i], err)
+			}
+			detectPlatform(images[i])
+			reportDigest(images[i])
+		}
+	}
+	// If only the supported targets were requested, list them and exit
+	if *listTargets {
+		for i, version := range versions {
+			targets, err := imageTargets(images[i])
+			if err != nil {
+				log.Fatalf("ERROR: Failed to list supported targets: %v.", err)
+			}
+			if len(versions) > 1 {
+				fmt.Printf("%s:\n", version)
+			}
+			for _, target := range targets {
+				fmt.Println(target)
 			}
-		default:
-			log.Println("INFO: Docker image found!")
 		}
+		return
 	}
 	// Cache all external dependencies to prevent always hitting the internet
 	if *crossDeps != "" {
@@ -123,10 +579,31 @@ func main() {
 		}
 		// Download all missing dependencies
 		for _, dep := range strings.Split(*crossDeps, " ") {
+			// Git dependencies are cloned at the requested ref within the containers
+			if url, ref, ok := gitDependency(strings.TrimSpace(dep)); ok {
+				if url == "" {
+					log.Fatalf("ERROR: Invalid git dependency %s, must be git+<url>[#<ref>].", dep)
+				}
+				if *offline {
+					log.Fatalf("ERROR: Git dependency %s can't be cloned with -offline.", url)
+				}
+				// Unpinned clones change under the same key, so their builds can't be cached
+				if ref == "" && *depsBuilt != "" {
+					log.Fatalf("ERROR: Git dependency %s must be pinned as git+<url>#<ref> to be built with -deps-cache.", url)
+				}
+				if ref == "" {
+					ref = "HEAD"
+				}
+				log.Printf("INFO: Dependency %s will be cloned at %s during the build.", url, ref)
+				continue
+			}
 			if url := strings.TrimSpace(dep); len(url) > 0 {
 				path := filepath.Join(depsCache, filepath.Base(url))
 
 				if _, err := os.Stat(path); err != nil {
+					if *offline {
+						log.Fatalf("ERROR: Dependency %s not cached in %s, required with -offline.", url, depsCache)
+					}
 					log.Printf("INFO: Downloading new dependency: %s...", url)
 					out, err := os.Create(path)
 					if err != nil {
@@ -145,32 +622,101 @@ func main() {
 
 					log.Printf("INFO: New dependency cached: %s.", path)
 				} else {
-					fmt.Printf("INFO: Dependency already cached: %s.", path)
+					log.Printf("INFO: Dependency already cached: %s.", path)
 				}
 			}
 		}
 	}
+	// Resolve the repository and the packages within it to build
+	repository, packages, err := resolvePackages(packageArgs, *srcPackage)
+	if err != nil {
+		log.Fatalf("ERROR: Failed to resolve requested packages: %v.", err)
+	}
+	if *offline && !isLocal(repository) {
+		log.Fatalf("ERROR: Remote package %s can't be fetched with -offline.", repository)
+	}
+	if *sinceRef != "" {
+		if !isLocal(repository) || *srcRemote != "" {
+			log.Fatalf("ERROR: Incremental builds with -since are only supported for local repositories.")
+		}
+		changed, err := changedPackages(repository, *moduleDir, packages, *sinceRef)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to detect packages changed since %s: %v.", *sinceRef, err)
+		}
+		for _, pkg := range packages {
+			if !contains(changed, pkg) {
+				log.Printf("INFO: Skipping %s, unchanged since %s.", filepath.Join(repository, filepath.FromSlash(pkg)), *sinceRef)
+			}
+		}
+		if len(changed) == 0 {
+			log.Printf("INFO: No packages changed since %s, nothing to build.", *sinceRef)
+			return
+		}
+		packages = changed
+	}
+	// Packages may be named independently by mapping them to their prefixes
+	if strings.Contains(*outPrefix, "=") {
+		if *outTemplate != "" {
+			log.Fatalf("ERROR: Output prefix mapping cannot be combined with -out-template.")
+		}
+		prefixes, err := mapPrefixes(*outPrefix, packages)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid output prefix mapping: %v.", err)
+		}
+		*outPrefix = strings.Join(prefixes, ",")
+	} else if len(packages) > 1 && *outPrefix != "" {
+		log.Fatalf("ERROR: Output prefix cannot be used with multiple packages, map them as pkg=name or use -out-template instead.")
+	}
+	if len(packages) > 1 && stream {
+		log.Fatalf("ERROR: Streaming the output to stdout requires a single package.")
+	}
+	// Split the configure arguments meant for all dependencies or single ones
+	unscoped, scoped := splitDepArgs(*crossArgs)
+
 	// Assemble the cross compilation environment and build options
 	config := &ConfigFlags{
-		Repository:   flag.Args()[0],
-		Package:      *srcPackage,
+		Repository:   repository,
+		Package:      strings.Join(packages, ","),
+		ModuleDir:    *moduleDir,
 		Remote:       *srcRemote,
 		Branch:       *srcBranch,
+		Revision:     *srcRevision,
+		ModVersion:   modVersion,
 		Prefix:       *outPrefix,
 		Dependencies: *crossDeps,
-		Arguments:    *crossArgs,
+		Arguments:    strings.TrimSpace(strings.Join(unscoped, " ")),
+		DepArguments: scoped,
 		Targets:      strings.Split(*targets, ","),
 	}
+	if *outTemplate != "" {
+		config.Version = sourceVersion(config)
+	}
 	log.Printf("DBG: config: %+v", config)
 	flags := &BuildFlags{
 		Verbose:  *buildVerbose,
 		Steps:    *buildSteps,
 		Race:     *buildRace,
 		Tags:     *buildTags,
-		LdFlags:  *buildLdFlags,
+		LdFlags:  strings.Join(unscopedValues(*buildLdFlags), " "),
 		Mode:     *buildMode,
 		VCS:      *buildVCS,
 		TrimPath: *buildTrimPath,
+		Static:   *buildStatic,
+		Debug:    *buildDebug,
+		Split:    *buildSplit,
+		Cover:    *buildCover,
+		Tests:    *buildTests,
+		Vet:      *buildVet,
+	}
+	if *buildRelease {
+		flags.LdFlags = strings.TrimSpace("-s -w " + flags.LdFlags)
+	}
+	if *buildStamp {
+		stamp, err := stampLdFlags(config)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to stamp build metadata: %v.", err)
+		}
+		flags.LdFlags = strings.TrimSpace(flags.LdFlags + " " + stamp)
 	}
 	log.Printf("DBG: flags: %+v", flags)
 	folder, err := os.Getwd()
@@ -182,76 +728,762 @@ func main() {
 		if err != nil {
 			log.Fatalf("ERROR: Failed to resolve destination path (%s): %v.", *outFolder, err)
 		}
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			log.Fatalf("ERROR: Failed to create destination folder: %v.", err)
+		}
+		if err := checkWritable(folder); err != nil {
+			log.Fatalf("ERROR: Destination folder is not writable: %v.", err)
+		}
 	}
-	// Execute the cross compilation, either in a container or the current system
-	if !xgoInXgo {
-		err = compile(image, config, flags, folder)
-	} else {
-		err = compileContained(config, flags, folder)
+	// Streamed outputs are built into a scratch folder, so no copy is left behind
+	if stream && !xgoInXgo {
+		if folder, err = os.MkdirTemp("", "xgo-stream-"); err != nil {
+			log.Fatalf("ERROR: Failed to create scratch output folder: %v.", err)
+		}
+		scratchFolders = append(scratchFolders, folder)
+		defer os.RemoveAll(folder)
+	}
+	// Running out of disk space midway produces cryptic failures, warn beforehand
+	if !*dryRun {
+		if err := checkDiskSpace(folder, !xgoInXgo && !*skipCheck); err != nil {
+			fatalf("ERROR: Not enough free disk space: %v.", err)
+		}
+	}
+	// Snapshot the output folder to find the artifacts the build produces
+	outputs, err := snapshotOutputs(folder)
+	if err != nil {
+		fatalf("ERROR: Failed to list destination folder contents: %v.", err)
 	}
+	// Abort the builds on interrupt or when running out of time, cleaning up after
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	// Execute the cross compilation for each Go release, either in a container or
+	// the current system. Multiple releases are built into their own subfolders.
+	var (
+		failures []string // Go releases the build failed with
+		failed   int      // Number of targets failed across all releases
+	)
+	toolchains := make([]string, len(versions)) // Concrete Go releases the images ship
+	for i, version := range versions {
+		dest := folder
+		if len(versions) > 1 {
+			log.Printf("INFO: Cross compiling with Go %s...", version)
+			dest = filepath.Join(folder, version)
+		}
+		// Wildcard releases like latest are resolved by the image, record the actual one
+		if !*dryRun {
+			toolchain, err := toolchainVersion(images[i])
+			if err != nil {
+				log.Printf("WARNING: Failed to detect the Go toolchain version: %v", err)
+			} else {
+				log.Printf("INFO: Using Go toolchain %s", toolchain)
+				toolchains[i] = toolchain
+			}
+		}
+		// Compilation resolves the repository in place, so work on a copy
+		config := *config
+		if config.Targets, err = resolveTargets(config.Targets, images[i]); err != nil {
+			fatalf("ERROR: Failed to validate build targets: %v.", err)
+		}
+		if *clean {
+			if err := cleanOutputs(dest, &config); err != nil {
+				fatalf("ERROR: Failed to clean stale outputs: %v.", err)
+			}
+		}
+		first := len(targetResults)
+		if !xgoInXgo {
+			err = compile(ctx, images[i], &config, flags, dest)
+		} else {
+			err = compileContained(ctx, &config, flags, dest)
+		}
+		for j := first; j < len(targetResults); j++ {
+			targetResults[j].Release = version
+		}
+		if err != nil {
+			// Failures to even start the builds abort, target failures are summarized
+			var berr *buildError
+			if !errors.As(err, &berr) {
+				fatalf("ERROR: Failed to cross compile package: %v.", err)
+			}
+			release := ""
+			if len(versions) > 1 {
+				release = " with Go " + version
+			}
+			log.Printf("ERROR: Failed to cross compile package%s: %v.", release, err)
+			if built := berr.succeeded(); len(built) > 0 {
+				log.Printf("INFO: Successfully built%s: %s", release, strings.Join(built, ", "))
+			}
+			failures = append(failures, version)
+			failed += len(berr.failed())
+			if *failFast {
+				break
+			}
+			continue
+		}
+		if *universal && !*dryRun {
+			if err := mergeUniversal(ctx, images[i], &config, dest); err != nil {
+				fatalf("ERROR: Failed to merge universal darwin binaries: %v.", err)
+			}
+		}
+	}
+	artifacts, err := newOutputs(folder, outputs)
+	if err != nil {
+		fatalf("ERROR: Failed to list produced artifacts: %v.", err)
+	}
+	built := expandTargets(config.Targets)
+	if *universal {
+		built = append(built, universalTarget)
+	}
+	names, err := outputNames(config, built)
 	if err != nil {
-		log.Fatalf("ERROR: Failed to cross compile package: %v.", err)
+		fatalf("ERROR: Failed to render output names: %v.", err)
+	}
+	saveReport := func(files []string) {
+		if *reportFile == "" {
+			return
+		}
+		if err := writeReport(*reportFile, targetResults, len(versions), files, names); err != nil {
+			fatalf("ERROR: Failed to write build report: %v.", err)
+		}
+		log.Printf("INFO: Build report written to %s.", *reportFile)
+	}
+	// Exit with the number of failed targets, capped below the shell reserved codes
+	if failed > 0 {
+		saveReport(artifacts)
+		if len(versions) > 1 {
+			log.Printf("ERROR: Failed to cross compile package with Go %s.", strings.Join(failures, ", "))
+		}
+		log.Printf("ERROR: %d targets failed to build.", failed)
+		exit(minInt(failed, 125))
+	}
+	if *layout == layoutNested {
+		if artifacts, err = nestOutputs(folder, artifacts, built, names); err != nil {
+			fatalf("ERROR: Failed to nest artifacts into target folders: %v.", err)
+		}
+	}
+	// Containers may map the outputs to any uid and mode, so settle them on the host
+	if *fileMode != "" {
+		if err := chmodOutputs(folder, artifacts, mode); err != nil {
+			fatalf("ERROR: Failed to set output permissions: %v.", err)
+		}
+	}
+	// Post build hooks may sign the outputs, so run them before any packaging
+	if *postBuild != "" {
+		if failed := runPostBuild(*postBuild, folder, artifacts); failed > 0 {
+			log.Printf("ERROR: Post-build command failed on %d artifacts.", failed)
+			exit(minInt(failed, 125))
+		}
 	}
+	// Guard against bloat of the outputs as shipped, so after any post build hook
+	if sizeLimit > 0 {
+		sizes, err := outputSizes(folder, artifacts)
+		if err != nil {
+			fatalf("ERROR: Failed to check output sizes: %v.", err)
+		}
+		var oversized int
+		for _, file := range artifacts {
+			if sizes[file] > sizeLimit {
+				log.Printf("ERROR: Output %s of %s is %s, over the maximum of %s.", file, outputTarget(file, built, names), formatBytes(uint64(sizes[file])), formatBytes(uint64(sizeLimit)))
+				oversized++
+			}
+		}
+		if oversized > 0 {
+			exit(minInt(oversized, 125))
+		}
+	}
+	if *archive != "" {
+		archives, err := packageArtifacts(folder, artifacts, built, names, *archive, extras)
+		if err != nil {
+			fatalf("ERROR: Failed to package artifacts: %v.", err)
+		}
+		log.Printf("INFO: Packaged artifacts into %d archives.", len(archives))
+
+		artifacts = append(artifacts, archives...)
+		sort.Strings(artifacts)
+	}
+	saveReport(artifacts)
+	if *manifest != "" {
+		if err := writeManifest(*manifest, strings.Join(images, ","), strings.Join(toolchains, ","), folder, artifacts, built, names, artifactLabels); err != nil {
+			fatalf("ERROR: Failed to write build manifest: %v.", err)
+		}
+		log.Printf("INFO: Build manifest written to %s.", *manifest)
+	}
+	if *checksums {
+		if err := writeChecksums(folder, artifacts); err != nil {
+			fatalf("ERROR: Failed to write artifact checksums: %v.", err)
+		}
+		log.Printf("INFO: Artifact checksums written to %s.", filepath.Join(folder, checksumsFile))
+	}
+	if stream && !*dryRun {
+		if len(artifacts) != 1 {
+			fatalf("ERROR: Streaming the output to stdout requires a single artifact, %d produced.", len(artifacts))
+		}
+		if err := copyFile(stdout, filepath.Join(folder, filepath.FromSlash(artifacts[0]))); err != nil {
+			fatalf("ERROR: Failed to stream %s to stdout: %v.", artifacts[0], err)
+		}
+		log.Printf("INFO: Streamed %s to stdout.", artifacts[0])
+	}
+}
+
+// Scratch folders to remove once done, including when exiting early, as deferred
+// calls are skipped by os.Exit.
+var scratchFolders []string
+
+// exit removes the scratch folders and exits with the given status code.
+func exit(code int) {
+	for _, folder := range scratchFolders {
+		os.RemoveAll(folder)
+	}
+	os.Exit(code)
+}
+
+// fatalf logs an error like log.Fatalf, removing the scratch folders before exiting.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	exit(1)
 }
 
 // Checks whether a docker installation can be found and is functional.
 func checkDocker() error {
-	log.Println("INFO: Checking docker installation...")
-	if err := run(exec.Command("docker", "version")); err != nil {
+	log.Printf("INFO: Checking %s installation...", *engine)
+	if err := run(exec.Command(*engine, "version")); err != nil {
+		var rerr *runError
+		switch {
+		case errors.Is(err, exec.ErrNotFound):
+			return fmt.Errorf("%s executable not found, please install it and ensure it is in your PATH", *engine)
+		case errors.As(err, &rerr) && daemonUnreachable(rerr.Output):
+			return fmt.Errorf("%s is installed but its daemon is unreachable, please ensure it is running and that DOCKER_HOST or CONTAINER_HOST (if set) is correct", *engine)
+		}
 		return err
 	}
-	fmt.Println()
 	return nil
 }
 
-// Checks whether a required docker image is available locally.
-func checkDockerImage(image string) bool {
-	log.Printf("INFO: Checking for required docker image %s... ", image)
-	err := exec.Command("docker", "image", "inspect", image).Run()
-	return err == nil
+// checkNetwork checks whether a docker network exists to attach the builds to.
+func checkNetwork(name string) error {
+	log.Printf("INFO: Checking for docker network %s...", name)
+	cmd := exec.Command(*engine, "network", "inspect", name)
+	cmd.Stdout = io.Discard
+	if err := run(cmd); err != nil {
+		var rerr *runError
+		if errors.As(err, &rerr) && strings.Contains(strings.ToLower(rerr.Output), "not found") {
+			return fmt.Errorf("network not found, create it with %s network create %s", *engine, name)
+		}
+		return err
+	}
+	return nil
 }
 
-// Pulls an image from the docker registry.
-func pullDockerImage(image string) error {
-	log.Printf("INFO: Pulling %s from docker registry...", image)
-	return run(exec.Command("docker", "pull", image))
+// daemonUnreachable checks if the output of a docker command reports that the
+// client could not connect to the daemon.
+func daemonUnreachable(output string) bool {
+	for _, msg := range []string{"Cannot connect to the Docker daemon", "Is the docker daemon running", "error during connect", "Cannot connect to Podman"} {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
 }
 
-// compile cross builds a requested package according to the given build specs
-// using a specific docker cross compilation image.
-func compile(image string, config *ConfigFlags, flags *BuildFlags, folder string) error {
-	// If a local build was requested, find the import path and mount all GOPATH sources
-	locals, mounts, paths := []string{}, []string{}, []string{}
-	var usesModules bool
-	if strings.HasPrefix(config.Repository, string(filepath.Separator)) || strings.HasPrefix(config.Repository, ".") {
-		if fileExists(filepath.Join(config.Repository, "go.mod")) {
-			usesModules = true
+// errImageNotFound is returned if a docker image is not available locally.
+var errImageNotFound = errors.New("image not found locally")
+
+// Checks whether a required docker image is available locally, returning
+// errImageNotFound if it is missing.
+func checkDockerImage(image string) error {
+	log.Printf("INFO: Checking for required docker image %s...", image)
+	out, err := exec.Command(*engine, "image", "inspect", image).CombinedOutput()
+	switch {
+	case err == nil:
+		return nil
+	case daemonUnreachable(string(out)):
+		return fmt.Errorf("failed to inspect image: %s", strings.TrimSpace(string(out)))
+	default:
+		return errImageNotFound
+	}
+}
+
+// ensureDockerImage checks that a docker image is available locally, pulling it
+// from the registry as the requested pull policy allows.
+func ensureDockerImage(image string) error {
+	switch {
+	case *dryRun:
+		log.Println("INFO: Dry run, skipping docker image checks")
+	case *imagePull == "always":
+		if err := pullDockerImage(image); err != nil {
+			return fmt.Errorf("failed to pull from the registry: %v", err)
 		}
-		if !usesModules {
-			// Resolve the repository import path from the file path
-			config.Repository = resolveImportPath(config.Repository)
-			if fileExists(filepath.Join(config.Repository, "go.mod")) {
-				usesModules = true
+	default:
+		err := checkDockerImage(image)
+		switch {
+		case err == nil:
+			log.Println("INFO: Docker image found!")
+		case !errors.Is(err, errImageNotFound):
+			return err
+		case *imagePull == "never":
+			return errors.New("not found locally and pulling is disabled")
+		default:
+			log.Println("INFO: Docker image not found!")
+			if err := pullDockerImage(image); err != nil {
+				return fmt.Errorf("failed to pull from the registry: %v", err)
 			}
 		}
-		if !usesModules {
-			log.Println("INFO: go.mod not found. Skipping go modules")
-		}
+	}
+	return nil
+}
 
-		gopathEnv := os.Getenv("GOPATH")
-		if gopathEnv == "" && !usesModules {
-			log.Printf("INFO: No $GOPATH is set - defaulting to %s", build.Default.GOPATH)
-			gopathEnv = build.Default.GOPATH
+// Pulls an image from the docker registry.
+func pullDockerImage(image string) error {
+	if *pullLogin {
+		if err := loginRegistry(image); err != nil {
+			return fmt.Errorf("failed to log into registry: %v", err)
+		}
+	}
+	log.Printf("INFO: Pulling %s from docker registry...", image)
+	err := pullWithRetries(append(append([]string{"pull"}, platformArgs()...), image))
+
+	var rerr *runError
+	if errors.As(err, &rerr) && *dockerPlat == "" && runtime.GOARCH != "amd64" && strings.Contains(rerr.Output, "no matching manifest") {
+		// The image is not published for the host, fall back to emulating amd64
+		log.Printf("WARNING: Image %s not available for %s, pulling linux/amd64 to run under emulation", image, runtime.GOARCH)
+		*dockerPlat = "linux/amd64"
+		err = pullWithRetries([]string{"pull", "--platform", *dockerPlat, image})
+	}
+	if errors.As(err, &rerr) && rateLimited(rerr.Output) {
+		return fmt.Errorf("registry %s rate limited the pull, run docker login to raise the limit, retry later or pull from a mirror with -docker-repo: %v", registryHost(image), err)
+	}
+	if errors.As(err, &rerr) && authFailed(rerr.Output) {
+		return fmt.Errorf("registry %s denied access, run docker login or use -registry-auth: %v", registryHost(image), err)
+	}
+	return err
+}
+
+// pullWithRetries runs a docker pull command, retrying it with exponential backoff
+// as long as it fails with transient errors, at most -pull-retries times.
+func pullWithRetries(args []string) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := run(exec.Command(*engine, args...))
+
+		var rerr *runError
+		if err == nil || attempt >= *pullRetries || !errors.As(err, &rerr) || !transientPullError(rerr.Output) {
+			return err
+		}
+		log.Printf("WARNING: Image pull failed with a transient error, retrying in %v (%d/%d)...", delay, attempt+1, *pullRetries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// transientPullError checks if the output of a failed docker pull reports an error
+// worth retrying, like network hiccups or registry outages. Authentication and
+// missing image errors are never retried.
+func transientPullError(output string) bool {
+	output = strings.ToLower(output)
+	// Rate limits are lifted over time, even if reported as denied access
+	if rateLimited(output) {
+		return true
+	}
+	if authFailed(output) {
+		return false
+	}
+	for _, msg := range []string{"manifest unknown", "not found", "no matching manifest"} {
+		if strings.Contains(output, msg) {
+			return false
+		}
+	}
+	for _, msg := range []string{"timeout", "timed out", "connection reset", "connection refused", "tls handshake", "unexpected eof", "temporary failure", "500 internal", "502 bad gateway", "503 service", "504 gateway"} {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectPlatform picks the platform to run an image with if none was requested,
+// which is only needed if the image is not built for the host architecture, e.g.
+// an amd64 only image on arm64 hosts.
+func detectPlatform(image string) {
+	if *dockerPlat != "" || *dryRun {
+		return
+	}
+	out, err := exec.Command(*engine, "image", "inspect", "--format", "{{.Os}}/{{.Architecture}}", image).Output()
+	if err != nil {
+		return
+	}
+	if platform := strings.TrimSpace(string(out)); platform != "" && platform != "linux/"+runtime.GOARCH {
+		log.Printf("INFO: Running %s image %s under emulation", platform, image)
+		*dockerPlat = platform
+	}
+}
+
+// toolchainVersion returns the version of the Go toolchain within an image, e.g.
+// 1.21.5 for an image selected by the latest release. An empty image asks the Go
+// toolchain of the current system.
+func toolchainVersion(image string) (string, error) {
+	cmd := exec.Command("go", "version")
+	if image != "" {
+		args := append(append([]string{"run", "--rm"}, platformArgs()...), "--entrypoint", "go", image, "version")
+		cmd = exec.Command(*engine, args...)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", strings.Join(cmd.Args[:2], " "), err)
+	}
+	// The output is in the form of: go version go1.21.5 linux/amd64
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "go") {
+		return "", fmt.Errorf("unexpected go version output: %s", strings.TrimSpace(string(out)))
+	}
+	return strings.TrimPrefix(fields[2], "go"), nil
+}
+
+// targetCompiler returns the compiler requested for a target, the last one given
+// if several apply, or an empty string to use the default of the target.
+func targetCompiler(compilers []string, target string) string {
+	if values := scopedValues(compilers, target); len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+// checkCompilers verifies that the C and C++ compilers requested for the targets
+// exist within an image, failing early instead of midway through the builds. An
+// empty image checks the current system.
+func checkCompilers(image string, targets []string) error {
+	var compilers []string
+	for _, target := range targets {
+		for _, compiler := range []string{targetCompiler(*cCompiler, target), targetCompiler(*cxxCompiler, target)} {
+			if compiler != "" {
+				compilers = appendUnique(compilers, compiler)
+			}
+		}
+	}
+	if len(compilers) == 0 {
+		return nil
+	}
+	if image == "" {
+		for _, compiler := range compilers {
+			if _, err := exec.LookPath(compiler); err != nil {
+				return fmt.Errorf("compiler %s not found", compiler)
+			}
+		}
+		return nil
+	}
+	script := `for cc; do command -v "$cc" >/dev/null || { echo "$cc"; exit 1; }; done`
+	args := append(append([]string{"run", "--rm"}, platformArgs()...), "--entrypoint", "/bin/sh", image, "-c", script, "sh")
+	out, err := exec.Command(*engine, append(args, compilers...)...).Output()
+	if missing := strings.TrimSpace(string(out)); err != nil && missing != "" {
+		return fmt.Errorf("compiler %s not found in image %s", missing, image)
+	}
+	return err
+}
+
+// Units of the memory limits accepted by the container engines, longest first.
+var memoryUnits = []string{"kib", "mib", "gib", "tib", "pib", "kb", "mb", "gb", "tb", "pb", "k", "m", "g", "t", "p", "b"}
+
+// validateLimits checks the resource limits of the build containers are in the
+// format the container engines accept, a size with an optional unit such as 512m,
+// 2g or 2GiB for the memory and a positive fractional number of CPUs.
+func validateLimits(memory string, cpus string) error {
+	if memory != "" {
+		value := strings.ToLower(memory)
+		for _, unit := range memoryUnits {
+			if strings.HasSuffix(value, unit) {
+				value = strings.TrimSuffix(value, unit)
+				break
+			}
+		}
+		if n, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || n <= 0 {
+			return fmt.Errorf("memory %q must be a positive size like 512m or 2g", memory)
+		}
+	}
+	if cpus != "" {
+		if n, err := strconv.ParseFloat(cpus, 64); err != nil || n <= 0 {
+			return fmt.Errorf("cpus %q must be a positive number like 1.5", cpus)
+		}
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes with an optional unit, in the same format as
+// the memory limit, with all units binary ones.
+func parseSize(size string) (int64, error) {
+	value, multiplier := strings.ToLower(size), float64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(value, unit) {
+			value = strings.TrimSuffix(value, unit)
+			if idx := strings.IndexByte("kmgtp", unit[0]); idx >= 0 {
+				multiplier = float64(int64(1) << (10 * (idx + 1)))
+			}
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("must be a positive size like 512k, 50m or 1g")
+	}
+	return int64(n * multiplier), nil
+}
+
+// normalizeGoVersion trims a requested Go release of surrounding whitespace and
+// a leading go, as in the go version output, and checks it is one the images are
+// tagged with: latest, a release like 1.21 or 1.21.5, a pre-release like 1.22rc1
+// or a point release wildcard like 1.21.x.
+func normalizeGoVersion(version string) (string, error) {
+	version = strings.TrimSpace(version)
+	if strings.HasPrefix(version, "go") && len(version) > 2 && isDigits(version[2:3]) {
+		version = version[2:]
+	}
+	if version == "latest" {
+		return version, nil
+	}
+	release := version
+	for _, pre := range []string{"rc", "beta"} {
+		if idx := strings.Index(release, pre); idx > 0 && isDigits(release[idx+len(pre):]) {
+			release = release[:idx]
+		}
+	}
+	parts := strings.Split(release, ".")
+	if len(parts) > 3 {
+		return "", errors.New("too many version components")
+	}
+	for i, part := range parts {
+		if part == "x" && i > 0 && i == len(parts)-1 && release == version {
+			continue
+		}
+		if !isDigits(part) {
+			return "", errors.New("must be latest, a release like 1.21.5 or a wildcard like 1.21.x")
+		}
+	}
+	return version, nil
+}
+
+// goReleaseBefore checks if a normalized Go release is older than the given minor
+// release of Go 1. The latest release is never older.
+func goReleaseBefore(version string, minor int) bool {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || parts[0] != "1" {
+		return false
+	}
+	release := parts[1]
+	for _, pre := range []string{"rc", "beta"} {
+		if idx := strings.Index(release, pre); idx > 0 {
+			release = release[:idx]
+		}
+	}
+	n, err := strconv.Atoi(release)
+	return err == nil && n < minor
+}
+
+// isDigits checks if a string is a non-empty sequence of decimal digits.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validateDigest checks that an image digest is a well formed SHA256 digest.
+func validateDigest(digest string) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return errors.New("must start with sha256:")
+	}
+	if sum, err := hex.DecodeString(strings.TrimPrefix(digest, "sha256:")); err != nil || len(sum) != sha256.Size {
+		return errors.New("must be followed by 64 hex characters")
+	}
+	return nil
+}
+
+// reportDigest prints the digest an image resolved to, so it can be pinned in
+// later builds via -docker-digest or an image@digest reference.
+func reportDigest(image string) {
+	if *dryRun {
+		return
+	}
+	out, err := exec.Command(*engine, "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", image).Output()
+	if err != nil {
+		return
+	}
+	// Images may be known under multiple repositories, prefer the requested one
+	repo := imageRepository(image)
+
+	var digest string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if digest == "" || imageRepository(line) == repo {
+			digest = line
+		}
+	}
+	if digest != "" {
+		log.Printf("INFO: Docker image %s resolved to %s", image, digest)
+	}
+}
+
+// imageRepository strips the tag and digest from an image reference.
+func imageRepository(image string) string {
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		image = image[:idx]
+	}
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		image = image[:idx]
+	}
+	return image
+}
+
+// imageName returns the image to build with a Go release in, either the official
+// or a custom one, pinned to the requested digest if any.
+func imageName(version string) string {
+	image := fmt.Sprintf("%s:%s", dockerDist, version)
+	if *dockerImage != "" {
+		image = *dockerImage
+	} else if *dockerRepo != "" {
+		image = fmt.Sprintf("%s:%s", *dockerRepo, version)
+	}
+	if *imageDigest != "" {
+		image += "@" + *imageDigest
+	}
+	return image
+}
+
+// platformArgs returns the docker arguments selecting the builder platform.
+func platformArgs() []string {
+	if *dockerPlat == "" {
+		return nil
+	}
+	return []string{"--platform", *dockerPlat}
+}
+
+// userArgs returns the docker arguments running a container as the requested user,
+// so that the outputs are owned by it instead of root. In auto mode, the host user
+// is picked on Linux, where docker runs the containers as root, unless the build
+// needs root to install CGO dependencies or fetch sources into the image GOPATH.
+func userArgs(root bool) []string {
+	user := *dockerUser
+	if user == "auto" {
+		if runtime.GOOS != "linux" || *engine != "docker" || os.Getuid() <= 0 || root {
+			return nil
+		}
+		user = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+	if user == "" {
+		return nil
+	}
+	// Users unknown to the image have / as home, git and go need a writable one
+	return []string{"--user", user, "-e", "HOME=/tmp"}
+}
+
+// authFailed checks if the output of a docker command reports that the registry
+// rejected the credentials or requires authentication.
+func authFailed(output string) bool {
+	output = strings.ToLower(output)
+	for _, msg := range []string{"unauthorized", "authentication required", "denied", "no basic auth credentials"} {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimited checks if the output of a docker command reports that the registry
+// refused it for exceeding its pull rate limit, like Docker Hub does.
+func rateLimited(output string) bool {
+	output = strings.ToLower(output)
+	for _, msg := range []string{"toomanyrequests", "429 too many requests", "pull rate limit"} {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// registryHost extracts the registry host from an image reference, defaulting
+// to Docker Hub if the reference does not start with one.
+func registryHost(image string) string {
+	if idx := strings.Index(image, "/"); idx > 0 {
+		if host := image[:idx]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			return host
+		}
+	}
+	return "docker.io"
+}
+
+// loginRegistry logs into the registry of an image with the credentials taken
+// from the XGO_REGISTRY_USER and XGO_REGISTRY_PASSWORD environment variables.
+func loginRegistry(image string) error {
+	user, pass := os.Getenv("XGO_REGISTRY_USER"), os.Getenv("XGO_REGISTRY_PASSWORD")
+	if user == "" || pass == "" {
+		return errors.New("XGO_REGISTRY_USER and XGO_REGISTRY_PASSWORD must be set")
+	}
+	host := registryHost(image)
+	log.Printf("INFO: Logging into %s as %s...", host, user)
+
+	cmd := exec.Command(*engine, "login", "--username", user, "--password-stdin", host)
+	cmd.Stdin = strings.NewReader(pass)
+	return run(cmd)
+}
+
+// compile cross builds a requested package according to the given build specs
+// using a specific docker cross compilation image.
+func compile(ctx context.Context, image string, config *ConfigFlags, flags *BuildFlags, folder string) error {
+	targets := buildTargetList(config.Targets, flags)
+	if len(targets) == 0 {
+		return errNoTargets
+	}
+	// If a local build was requested, find the import path and mount all GOPATH sources
+	locals, mounts, paths := []string{}, []string{}, []string{}
+	var usesModules bool
+	var goFlags string // GOFLAGS overridden for vendored modules, if any
+	if isLocal(config.Repository) {
+		if fileExists(filepath.Join(config.Repository, config.ModuleDir, "go.mod")) {
+			usesModules = true
+		} else if config.ModuleDir != "" {
+			return fmt.Errorf("no go.mod found in module folder %s", filepath.Join(config.Repository, config.ModuleDir))
+		}
+		if !usesModules {
+			// Resolve the repository import path from the file path
+			repository, err := resolveImportPath(config.Repository)
+			if err != nil {
+				fatalf("ERROR: Failed to resolve import path: %v.", err)
+			}
+			config.Repository = repository
+			if fileExists(filepath.Join(config.Repository, "go.mod")) {
+				usesModules = true
+			}
+		}
+		if !usesModules {
+			log.Println("INFO: go.mod not found. Skipping go modules")
+		} else if goFlags = vendorGoFlags(filepath.Join(config.Repository, config.ModuleDir)); goFlags != "" {
+			log.Printf("INFO: Using vendored Go module dependencies")
+		}
+
+		gopathEnv := os.Getenv("GOPATH")
+		gopaths := gopathElements(gopathEnv)
+		if len(gopaths) == 0 && !usesModules {
+			if gopathEnv != "" {
+				log.Printf("WARNING: $GOPATH %q has no absolute elements, ignoring it", gopathEnv)
+			}
+			log.Printf("INFO: No $GOPATH is set - defaulting to %s", build.Default.GOPATH)
+			gopathEnv, gopaths = build.Default.GOPATH, gopathElements(build.Default.GOPATH)
 		}
 
 		// Iterate over all the local libs and export the mount points
-		if gopathEnv == "" && !usesModules {
-			log.Fatalf("INFO: No $GOPATH is set or forwarded to xgo")
+		if len(gopaths) == 0 && !usesModules {
+			fatalf("ERROR: No $GOPATH is set or forwarded to xgo, set it or run go mod init to build %s as a module.", config.Repository)
 		}
 
 		if !usesModules {
 			os.Setenv("GO111MODULE", "off")
-			for _, gopath := range strings.Split(gopathEnv, string(os.PathListSeparator)) {
+			for _, gopath := range gopaths {
 				// Since docker sandboxes volumes, resolve any symlinks manually
 				sources := filepath.Join(gopath, "src")
 				filepath.Walk(sources, func(path string, info os.FileInfo, err error) error {
@@ -289,50 +1521,166 @@ func compile(image string, config *ConfigFlags, flags *BuildFlags, folder string
 				paths = append(paths, filepath.ToSlash(filepath.Join("/ext-go", strconv.Itoa(len(locals)))))
 			}
 		}
+		// Verify the packages are reachable before launching the build
+		for _, pkg := range strings.Split(config.Package, ",") {
+			if usesModules {
+				if dir := filepath.Join(config.Repository, config.ModuleDir, filepath.FromSlash(pkg)); !isDir(dir) {
+					abs, _ := filepath.Abs(dir)
+					return fmt.Errorf("package folder %s not found within the module", abs)
+				}
+			} else if pkg = path.Join(config.Repository, pkg); !mountedPackage(locals, mounts, paths, pkg) {
+				return fmt.Errorf("package %s not found within the src folder of any GOPATH element (%s)", pkg, gopathEnv)
+			}
+		}
+	}
+	// Published module versions are downloaded within the container, as modules
+	if config.ModVersion != "" {
+		usesModules = true
 	}
 	// Assemble and run the cross compilation command
 	log.Printf("INFO: Cross compiling %s package...", config.Repository)
 
-	args := []string{
-		"run", "--rm",
+	args := []string{"run"}
+	if !*noCleanup {
+		args = append(args, "--rm")
+	}
+	args = append(args, []string{
 		"-v", folder + ":/build",
 		"-v", depsCache + ":/deps-cache:ro",
-		"-e", "REPO_REMOTE=" + config.Remote,
-		"-e", "REPO_BRANCH=" + config.Branch,
-		"-e", "PACK=" + config.Package,
-		"-e", "DEPS=" + config.Dependencies,
-		"-e", "ARGS=" + config.Arguments,
-		"-e", "OUT=" + config.Prefix,
-		"-e", fmt.Sprintf("FLAG_V=%v", flags.Verbose),
-		"-e", fmt.Sprintf("FLAG_X=%v", flags.Steps),
-		"-e", fmt.Sprintf("FLAG_RACE=%v", flags.Race),
-		"-e", fmt.Sprintf("FLAG_TAGS=%s", flags.Tags),
-		"-e", fmt.Sprintf("FLAG_LDFLAGS=%s", flags.LdFlags),
-		"-e", fmt.Sprintf("FLAG_BUILDMODE=%s", flags.Mode),
-		"-e", fmt.Sprintf("FLAG_BUILDVCS=%s", flags.VCS),
-		"-e", fmt.Sprintf("FLAG_TRIMPATH=%v", flags.TrimPath),
-		"-e", "TARGETS=" + strings.Replace(strings.Join(config.Targets, " "), "*", ".", -1),
+	}...)
+	args = append(args, platformArgs()...)
+	user := userArgs(config.Dependencies != "" || !usesModules)
+	args = append(args, user...)
+	if *memoryLimit != "" {
+		args = append(args, []string{"--memory", *memoryLimit}...)
+	}
+	if *cpuLimit != "" {
+		args = append(args, []string{"--cpus", *cpuLimit}...)
+	}
+	if *offline {
+		args = append(args, []string{"--network", "none", "-e", "GOPROXY=off"}...)
+	}
+	if *network != "" {
+		args = append(args, []string{"--network", *network}...)
+	}
+	for _, env := range buildEnv(config, flags) {
+		args = append(args, []string{"-e", env}...)
+	}
+	if *buildCache != "" {
+		cache, err := cacheFolder(*buildCache, image)
+		if err != nil {
+			return fmt.Errorf("failed to prepare build cache: %v", err)
+		}
+		args = append(args, []string{"-v", cache + ":/gocache", "-e", "GOCACHE=/gocache"}...)
+	}
+	if *depsBuilt != "" && config.Dependencies != "" {
+		cache, err := cacheFolder(*depsBuilt, image)
+		if err != nil {
+			return fmt.Errorf("failed to prepare dependency cache: %v", err)
+		}
+		args = append(args, []string{"-v", cache + ":/deps-built", "-e", "DEPS_CACHE=/deps-built", "-e", "DEPS_KEY=" + depsKey(config)}...)
+	}
+	if *winRes != "" {
+		// Mount the folder of the resource script, as it may reference icons within
+		script, err := filepath.Abs(*winRes)
+		if err != nil {
+			return fmt.Errorf("failed to locate windows resource script: %v", err)
+		}
+		args = append(args, []string{"-v", filepath.Dir(script) + ":/winres:ro", "-e", "WINRES=/winres/" + filepath.Base(script)}...)
+	}
+	if *netrcFile != "" {
+		// Both git and the go command look for credentials in the home folder
+		netrc, err := filepath.Abs(*netrcFile)
+		if err != nil {
+			return fmt.Errorf("failed to locate credentials file: %v", err)
+		}
+		home := "/root"
+		if user != nil {
+			home = "/tmp"
+		}
+		args = append(args, []string{"-v", netrc + ":" + home + "/.netrc:ro"}...)
+	}
+	command := "xgo-build"
+	if *buildScript != "" {
+		// Mount the custom build script, replacing the entrypoint of the image
+		script, err := filepath.Abs(*buildScript)
+		if err != nil {
+			return fmt.Errorf("failed to locate build script: %v", err)
+		}
+		command = "/xgo-script/" + filepath.Base(script)
+		args = append(args, []string{"-v", script + ":" + command + ":ro"}...)
+	}
+	for _, key := range forwardedEnv {
+		if key == "GOPROXY" && (*goProxy != "" || *offline) {
+			continue
+		}
+		if key == "GOFLAGS" && goFlags != "" {
+			continue
+		}
+		if value := os.Getenv(key); value != "" {
+			args = append(args, []string{"-e", key + "=" + value}...)
+		}
+	}
+	// Concurrent runs sharing the host GOPATH may contend, isolate them if requested
+	gopath := build.Default.GOPATH
+	if *isolated {
+		scratch, err := os.MkdirTemp("", "xgo-gopath-")
+		if err != nil {
+			return fmt.Errorf("failed to create isolated GOPATH: %v", err)
+		}
+		if *noCleanup {
+			log.Printf("INFO: Isolated GOPATH kept at %s", scratch)
+		} else {
+			defer removeScratch(image, scratch)
+		}
+		gopath = scratch
 	}
 	if usesModules {
+		// Without network, the module dependencies must all be cached already
+		if *offline && goFlags == "" && !isDir(filepath.Join(gopath, "pkg", "mod")) {
+			return fmt.Errorf("no module cache found in %s, warm it with go mod download before building with -offline", filepath.Join(gopath, "pkg", "mod"))
+		}
+		// Docker creates missing mount sources as root, unwritable to other users
+		if err := os.MkdirAll(gopath, 0755); err != nil {
+			return fmt.Errorf("failed to create GOPATH: %v", err)
+		}
 		args = append(args, []string{"-e", "GO111MODULE=on"}...)
-		args = append(args, []string{"-v", build.Default.GOPATH + ":/go"}...)
+		args = append(args, []string{"-v", gopath + ":/go"}...)
 		if *goProxy != "" {
 			args = append(args, []string{"-e", fmt.Sprintf("GOPROXY=%s", *goProxy)}...)
 		}
 
-		// Map this repository to the /source folder
-		absRepository, err := filepath.Abs(config.Repository)
-		if err != nil {
-			log.Fatalf("ERROR: Failed to locate requested module repository: %v.", err)
+		// Map this repository to the /source folder, unless downloaded in the container
+		if config.ModVersion == "" {
+			absRepository, err := filepath.Abs(config.Repository)
+			if err != nil {
+				fatalf("ERROR: Failed to locate requested module repository: %v.", err)
+			}
+			source := absRepository
+
+			// Go only stamps the VCS information found in the module folder or above it,
+			// so mount the whole work tree if the repository is within it
+			if flags.VCS == "true" {
+				root, ok := gitRoot(absRepository)
+				switch {
+				case !ok && root != "":
+					log.Printf("WARNING: %s is a git worktree or submodule, whose repository can't be mounted for -buildvcs.", root)
+				case ok && root != absRepository:
+					rel, err := filepath.Rel(root, filepath.Join(absRepository, config.ModuleDir))
+					if err != nil {
+						return fmt.Errorf("failed to locate module within git work tree: %v", err)
+					}
+					log.Printf("INFO: Mounting git work tree %s to stamp VCS information", root)
+					source = root
+					args = append(args, []string{"-e", "MODULE_DIR=" + filepath.ToSlash(rel)}...)
+				}
+			}
+			args = append(args, []string{"-v", source + ":/source"}...)
 		}
-		args = append(args, []string{"-v", absRepository + ":/source"}...)
 
-		// Check whether it has a vendor folder, and if so, use it
-		vendorPath := absRepository + "/vendor"
-		vendorfolder, err := os.Stat(vendorPath)
-		if !os.IsNotExist(err) && vendorfolder.Mode().IsDir() {
-			args = append(args, []string{"-e", "FLAG_MOD=vendor"}...)
-			log.Printf("INFO: Using vendored Go module dependencies")
+		// Build vendored modules from their vendor folder, without touching the network
+		if goFlags != "" {
+			args = append(args, []string{"-e", "FLAG_MOD=vendor", "-e", "GOFLAGS=" + goFlags}...)
 		}
 	} else {
 		args = append(args, []string{"-e", "GO111MODULE=off"}...)
@@ -340,38 +1688,330 @@ func compile(image string, config *ConfigFlags, flags *BuildFlags, folder string
 			args = append(args, []string{"-v", fmt.Sprintf("%s:%s:ro", locals[i], mounts[i])}...)
 		}
 		args = append(args, []string{"-e", "EXT_GOPATH=" + strings.Join(paths, ":")}...)
+		if *isolated {
+			args = append(args, []string{"-v", gopath + ":/go"}...)
+		}
 	}
 
-	args = append(args, []string{image, config.Repository}...)
-	log.Printf("INFO: Docker %s", strings.Join(args, " "))
-	return run(exec.Command("docker", args...))
+	// Assemble the container arguments of a single target, naming the container
+	// so it can be removed if the build is aborted
+	targetArgs := func(target string) ([]string, error) {
+		env, err := targetEnv(config, flags, target)
+		if err != nil {
+			return nil, err
+		}
+		args := append([]string{}, args...)
+		args = append(args, []string{"--name", containerName(target)}...)
+		for _, env := range env {
+			args = append(args, []string{"-e", env}...)
+		}
+		// Custom options come last, so they may override any of the above
+		for _, opt := range *dockerOpts {
+			args = append(args, strings.Fields(opt)...)
+		}
+		return args, nil
+	}
+	if !*dryRun {
+		if err := checkCompilers(image, targets); err != nil {
+			return err
+		}
+	}
+	if *shell {
+		return runShell(ctx, image, config, targets, command, targetArgs)
+	}
+	before, err := strictSnapshot(folder)
+	if err != nil {
+		return err
+	}
+	// Fan out a container for each target, prefixing their output if concurrent
+	return buildTargets(ctx, targets, *parallelism, func(ctx context.Context, target string, stdout, stderr io.Writer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		args, err := targetArgs(target)
+		if err != nil {
+			return err
+		}
+		name := containerName(target)
+		if *buildScript != "" {
+			args = append(args, []string{"--entrypoint", command}...)
+		}
+		args = append(args, []string{image, config.Repository}...)
+		if *dryRun {
+			fmt.Println(shellQuote(append([]string{*engine}, args...)))
+			return nil
+		}
+		if *noCleanup {
+			// Replace the container kept by a previous build of the same target
+			exec.Command(*engine, "rm", "--force", name).Run()
+		}
+		log.Printf("INFO: Running %s %s", *engine, strings.Join(args, " "))
+
+		cmd := exec.CommandContext(ctx, *engine, args...)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		err = run(cmd)
+		if err != nil && ctx.Err() != nil {
+			removeContainer(name)
+			return ctx.Err()
+		}
+		if err == nil && before != nil {
+			err = checkProduced(folder, before, config, target)
+		}
+		if *noCleanup {
+			log.Printf("INFO: Build container of %s kept as %s, remove it with %s rm %s", target, name, *engine, name)
+		}
+		return err
+	})
+}
+
+// runShell opens an interactive shell in the build container of a target instead
+// of building it, with the exact same mounts and environment as the build.
+func runShell(ctx context.Context, image string, config *ConfigFlags, targets []string, command string, targetArgs func(string) ([]string, error)) error {
+	if len(targets) != 1 {
+		return fmt.Errorf("debug shell requires a single target, %d requested", len(targets))
+	}
+	args, err := targetArgs(targets[0])
+	if err != nil {
+		return err
+	}
+	// Only allocate a terminal if there is one, allowing scripted sessions too
+	args = append(args, "-i")
+	if isTerminal(os.Stdin) {
+		args = append(args, "-t")
+	}
+	args = append(args, []string{"--entrypoint", "/bin/bash", image}...)
+	if *dryRun {
+		fmt.Println(shellQuote(append([]string{*engine}, args...)))
+		return nil
+	}
+	log.Printf("INFO: Opening shell for %s, run %s to start the build", targets[0], shellQuote([]string{command, config.Repository}))
+
+	cmd := exec.CommandContext(ctx, *engine, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// The exit code of the shell is the one of the last command run within
+	var eerr *exec.ExitError
+	if err := cmd.Run(); err != nil && !errors.As(err, &eerr) {
+		return err
+	}
+	return nil
 }
 
 // compileContained cross builds a requested package according to the given build
 // specs using the current system opposed to running in a container. This is meant
 // to be used for cross compilation already from within an xgo image, allowing the
 // inheritance and bundling of the root xgo images.
-func compileContained(config *ConfigFlags, flags *BuildFlags, folder string) error {
+func compileContained(ctx context.Context, config *ConfigFlags, flags *BuildFlags, folder string) error {
+	targets := buildTargetList(config.Targets, flags)
+	if len(targets) == 0 {
+		return errNoTargets
+	}
 	// If a local build was requested, resolve the import path
-	local := strings.HasPrefix(config.Repository, string(filepath.Separator)) || strings.HasPrefix(config.Repository, ".")
+	local := isLocal(config.Repository)
+	var goFlags string // GOFLAGS overridden for vendored modules, if any
+	var workdir string // Folder to run the build script in, if not the current one
 	if local {
-		// Resolve the repository import path from the file path
-		config.Repository = resolveImportPath(config.Repository)
-
-		// Determine if this is a module-based repository
-		usesModules := fileExists(filepath.Join(config.Repository, "go.mod"))
+		// Modules in subfolders are built from within, no sources need to be mapped
+		if config.ModuleDir != "" {
+			workdir = filepath.Join(config.Repository, config.ModuleDir)
+			if !fileExists(filepath.Join(workdir, "go.mod")) {
+				return fmt.Errorf("no go.mod found in module folder %s", workdir)
+			}
+			config.Repository, config.ModuleDir = ".", ""
+		}
+		// Determine if this is a module-based repository, which must be built from
+		// its folder as there is no GOPATH import path to resolve
+		usesModules := fileExists(filepath.Join(workdir, config.Repository, "go.mod"))
 		if !usesModules {
+			// Resolve the repository import path from the file path
+			repository, err := resolveImportPath(config.Repository)
+			if err != nil {
+				fatalf("ERROR: Failed to resolve import path: %v.", err)
+			}
+			config.Repository = repository
+
 			os.Setenv("GO111MODULE", "off")
 			log.Println("INFO: Don't use go modules (go.mod not found)")
+		} else if goFlags = vendorGoFlags(filepath.Join(workdir, config.Repository)); goFlags != "" {
+			log.Printf("INFO: Using vendored Go module dependencies")
 		}
 	}
 	// Fine tune the original environment variables with those required by the build script
+	env := buildEnv(config, flags)
+	if goFlags != "" {
+		env = append(env, "FLAG_MOD=vendor", "GOFLAGS="+goFlags)
+	}
+	if *offline {
+		env = append(env, "GOPROXY=off")
+	}
+	if *buildCache != "" {
+		cache, err := cacheFolder(*buildCache, "")
+		if err != nil {
+			return fmt.Errorf("failed to prepare build cache: %v", err)
+		}
+		env = append(env, "GOCACHE="+cache)
+	}
+	if *depsBuilt != "" && config.Dependencies != "" {
+		cache, err := cacheFolder(*depsBuilt, "")
+		if err != nil {
+			return fmt.Errorf("failed to prepare dependency cache: %v", err)
+		}
+		env = append(env, "DEPS_CACHE="+cache, "DEPS_KEY="+depsKey(config))
+	}
+	if *winRes != "" {
+		script, err := filepath.Abs(*winRes)
+		if err != nil {
+			return fmt.Errorf("failed to locate windows resource script: %v", err)
+		}
+		env = append(env, "WINRES="+script)
+	}
+	if *netrcFile != "" {
+		netrc, err := filepath.Abs(*netrcFile)
+		if err != nil {
+			return fmt.Errorf("failed to locate credentials file: %v", err)
+		}
+		env = append(env, "NETRC="+netrc)
+	}
+	if local {
+		env = append(env, "EXT_GOPATH=/non-existent-path-to-signal-local-build")
+	}
+	command := "xgo-build"
+	if *buildScript != "" {
+		script, err := filepath.Abs(*buildScript)
+		if err != nil {
+			return fmt.Errorf("failed to locate build script: %v", err)
+		}
+		command = script
+	}
+	// Assemble and run the local cross compilation command
+	log.Printf("INFO: Cross compiling %s package...", config.Repository)
+
+	if err := checkCompilers("", targets); err != nil {
+		return err
+	}
+	before, err := strictSnapshot(folder)
+	if err != nil {
+		return err
+	}
+	// The build script modifies the system it runs on, so targets go one by one
+	return buildTargets(ctx, targets, 1, func(ctx context.Context, target string, stdout, stderr io.Writer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		extra, err := targetEnv(config, flags, target)
+		if err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, command, config.Repository)
+		cmd.Dir = workdir
+		cmd.Env = append(append(os.Environ(), env...), extra...)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		if err := run(cmd); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if before != nil {
+			return checkProduced(folder, before, config, target)
+		}
+		return nil
+	})
+}
+
+// vendorGoFlags returns the GOFLAGS to build a module from its vendor folder with,
+// extending those forwarded from the host, or an empty string if the module is
+// not vendored. Beside the builds, this also keeps every other go invocation of
+// the build script from fetching modules over the network.
+func vendorGoFlags(root string) string {
+	if info, err := os.Stat(filepath.Join(root, "vendor")); err != nil || !info.IsDir() {
+		return ""
+	}
+	return strings.TrimSpace(os.Getenv("GOFLAGS") + " -mod=vendor")
+}
+
+// cacheFolder returns the absolute path of the Go build cache to use within the
+// requested cache folder, creating it if needed. Caches are kept separate for
+// each image, so switching between Go releases does not mix their outputs.
+func cacheFolder(folder string, image string) (string, error) {
+	if image != "" {
+		folder = filepath.Join(folder, strings.NewReplacer("/", "_", ":", "_").Replace(image))
+	}
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return "", err
+	}
+	return folder, os.MkdirAll(folder, 0755)
+}
+
+// depsKey returns a hash of the dependency archive URLs, so that cached builds of
+// the dependencies are invalidated when any of them changes.
+func depsKey(config *ConfigFlags) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(config.Dependencies), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// containerName returns a name unique to this xgo invocation for the container
+// building the given target. Containers kept after the build are named after
+// the target alone, so they can be found without digging through the logs.
+func containerName(target string) string {
+	name := strings.NewReplacer("/", "-", ".", "_", "*", "all").Replace(target)
+	if *noCleanup {
+		return "xgo-" + name
+	}
+	return fmt.Sprintf("xgo-%d-%s", os.Getpid(), name)
+}
+
+// gopathElements splits a GOPATH into its elements, skipping the empty and the
+// relative ones the go tool ignores too, as they can't be mounted.
+func gopathElements(gopath string) []string {
+	var elements []string
+	for _, element := range filepath.SplitList(gopath) {
+		if element != "" && filepath.IsAbs(element) {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// removeScratch removes an isolated GOPATH once the builds are done. The files
+// within are owned by the user of the containers and the module cache is read
+// only, so they are deleted from within a container first.
+func removeScratch(image string, dir string) {
+	if !*dryRun {
+		args := append([]string{"run", "--rm", "-v", dir + ":/scratch"}, platformArgs()...)
+		args = append(args, []string{"--entrypoint", "find", image, "/scratch", "-mindepth", "1", "-delete"}...)
+		if out, err := exec.Command(*engine, args...).CombinedOutput(); err != nil {
+			log.Printf("WARNING: Failed to empty isolated GOPATH %s: %v, %s", dir, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("WARNING: Failed to remove isolated GOPATH %s: %v", dir, err)
+	}
+}
+
+// removeContainer forcefully stops and removes a container left behind by an
+// aborted build. Failures are only reported as the build failed already.
+func removeContainer(name string) {
+	log.Printf("INFO: Removing container %s...", name)
+	if out, err := exec.Command(*engine, "rm", "--force", name).CombinedOutput(); err != nil {
+		log.Printf("WARNING: Failed to remove container %s: %v, %s", name, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// buildEnv assembles the environment variables required by the build script to
+// cross compile the requested package, apart from the targets to build for.
+func buildEnv(config *ConfigFlags, flags *BuildFlags) []string {
 	env := []string{
 		"REPO_REMOTE=" + config.Remote,
 		"REPO_BRANCH=" + config.Branch,
+		"REPO_REV=" + config.Revision,
+		"MODULE_VERSION=" + config.ModVersion,
 		"PACK=" + config.Package,
+		"MODULE_DIR=" + config.ModuleDir,
 		"DEPS=" + config.Dependencies,
 		"ARGS=" + config.Arguments,
+		"DEPS_ARGS=" + strings.Join(config.DepArguments, "\n"),
 		"OUT=" + config.Prefix,
 		fmt.Sprintf("FLAG_V=%v", flags.Verbose),
 		fmt.Sprintf("FLAG_X=%v", flags.Steps),
@@ -381,44 +2021,589 @@ func compileContained(config *ConfigFlags, flags *BuildFlags, folder string) err
 		fmt.Sprintf("FLAG_BUILDMODE=%s", flags.Mode),
 		fmt.Sprintf("FLAG_BUILDVCS=%s", flags.VCS),
 		fmt.Sprintf("FLAG_TRIMPATH=%v", flags.TrimPath),
-		"TARGETS=" + strings.Replace(strings.Join(config.Targets, " "), "*", ".", -1),
+		fmt.Sprintf("FLAG_DEBUG=%v", flags.Debug),
+		fmt.Sprintf("FLAG_SPLIT=%v", flags.Split),
+		fmt.Sprintf("FLAG_COVER=%v", flags.Cover),
+		fmt.Sprintf("FLAG_TESTS=%v", flags.Tests),
+		fmt.Sprintf("FLAG_VET=%v", flags.Vet),
 	}
-	if local {
-		env = append(env, "EXT_GOPATH=/non-existent-path-to-signal-local-build")
+	return append(env, *extraEnv...)
+}
+
+// splitDepArgs splits dependency configure arguments into the ones meant for all
+// dependencies and the ones scoped to a single dependency in the archive:args
+// form. Scoped ones are keyed by the folder the archive extracts into, which is
+// assumed to be the archive name without extension.
+func splitDepArgs(values []string) ([]string, []string) {
+	var unscoped, scoped []string
+	for _, value := range values {
+		idx := strings.Index(value, ":")
+		if idx <= 0 || strings.HasPrefix(value, "-") || strings.ContainsAny(value[:idx], " =") {
+			unscoped = append(unscoped, value)
+			continue
+		}
+		name := value[:idx]
+		for _, ext := range []string{".tar.gz", ".tar.bz2", ".tgz", ".tar"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		scoped = append(scoped, name+":"+value[idx+1:])
 	}
-	// Assemble and run the local cross compilation command
-	log.Printf("INFO: Cross compiling %s package...", config.Repository)
+	return unscoped, scoped
+}
 
-	cmd := exec.Command("xgo-build", config.Repository)
-	cmd.Env = append(os.Environ(), env...)
+// targetEnv assembles the environment variables required by the build script to
+// cross compile the requested package for a single target.
+func targetEnv(config *ConfigFlags, flags *BuildFlags, target string) ([]string, error) {
+	env := []string{"TARGETS=" + target}
 
-	return run(cmd)
+	if cflags := scopedValues(*cgoCFlags, target); len(cflags) > 0 {
+		env = append(env, "CGO_CFLAGS="+strings.Join(cflags, " "))
+	}
+	if ldflags := scopedValues(*cgoLdFlags, target); len(ldflags) > 0 {
+		env = append(env, "CGO_LDFLAGS="+strings.Join(ldflags, " "))
+	}
+	if cc := targetCompiler(*cCompiler, target); cc != "" {
+		env = append(env, "TARGET_CC="+cc)
+	}
+	if cxx := targetCompiler(*cxxCompiler, target); cxx != "" {
+		env = append(env, "TARGET_CXX="+cxx)
+	}
+	cgo := cgoEnabled(*cgoMode, target)
+	if !cgo {
+		env = append(env, "FLAG_CGO=false")
+	}
+	// Target specific linker flags are appended to those of all targets
+	ldflags := flags.LdFlags
+	for _, value := range *buildLdFlags {
+		if scope, value := splitScoped(value); scope != "" && matchTarget(scope, target) {
+			ldflags = strings.TrimSpace(ldflags + " " + value)
+		}
+	}
+	if ldflags != flags.LdFlags {
+		env = append(env, "FLAG_LDFLAGS="+ldflags)
+	}
+	// Static PIE needs the external linker, falling back to regular builds elsewhere
+	if flags.Static {
+		if cgo && supportsStaticPIE(target) {
+			env = append(env, "FLAG_BUILDMODE=pie", "FLAG_LDFLAGS="+strings.TrimSpace(ldflags+" -linkmode=external -extldflags=-static-pie"))
+		} else {
+			log.Printf("WARNING: Static PIE not supported on %s, building a regular binary.", target)
+		}
+	}
+	// The race detector needs cgo, dropping it elsewhere unless strict
+	if flags.Race && (!cgo || !supportsRace(target)) {
+		if *strict {
+			return nil, fmt.Errorf("race detector not supported on %s", target)
+		}
+		log.Printf("WARNING: Race detector not supported on %s, building without it.", target)
+		env = append(env, "FLAG_RACE=false")
+	}
+	// Debug symbols are split with objcopy, which only handles ELF binaries
+	if goos, _ := targetPlatform(target); flags.Split && goos != "linux" {
+		log.Printf("WARNING: Splitting debug symbols not supported on %s, keeping them in the binary.", target)
+		env = append(env, "FLAG_SPLIT=false")
+	}
+
+	// Target specific variables come last, overriding any set for all targets
+	for _, value := range *targetVars {
+		if scope, variable := splitScoped(value); matchTarget(scope, target) {
+			env = append(env, variable)
+		}
+	}
+	// Templated names are passed in the same order as the packages to build
+	var names []string
+	for _, config := range packageConfigs(config) {
+		name, err := outputName(config, target)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		env = append(env, "OUT_NAME="+strings.Join(names, ","))
+	}
+	return env, nil
+}
+
+// validateCgoMode checks that every requested cgo mode is one of true, false or
+// auto, and that the scoped ones refer to supported targets.
+func validateCgoMode(modes []string) error {
+	for _, mode := range modes {
+		switch _, value := splitScoped(mode); value {
+		case "true", "false", "auto":
+		default:
+			return fmt.Errorf("invalid mode %q, must be one of true, false or auto", mode)
+		}
+	}
+	return validateScoped(modes)
+}
+
+// cgoEnabled checks if cgo is enabled for a target. The last of the modes applying
+// to the target wins, with cgo enabled in auto mode or if none was requested.
+func cgoEnabled(modes []string, target string) bool {
+	values := scopedValues(modes, target)
+	return len(values) == 0 || values[len(values)-1] != "false"
+}
+
+// buildTargets runs the build function for every target, with at most limit of
+// them in flight at once. If multiple targets are built, their output is prefixed
+// with the target name. A failing target does not abort the remaining ones unless
+// failing fast, all failures are collected and reported at the end.
+func buildTargets(ctx context.Context, targets []string, limit int, build func(ctx context.Context, target string, stdout, stderr io.Writer) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	// Failing fast cancels the builds in flight, which remove their containers
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		pend      sync.WaitGroup
+		sema      = make(chan struct{}, limit)
+		results   = make([]error, len(targets))
+		durations = make([]time.Duration, len(targets))
+	)
+	for i, target := range targets {
+		sema <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-sema
+			results[i] = err
+			continue
+		}
+		pend.Add(1)
+
+		go func(i int, target string) {
+			defer func() { <-sema; pend.Done() }()
+
+			// Report the progress once the output of the target is flushed
+			if !*dryRun {
+				log.Printf("INFO: [%d/%d] Building %s...", i+1, len(targets), target)
+
+				start := time.Now()
+				defer func() {
+					status := "done"
+					if results[i] != nil {
+						status = "failed"
+					}
+					durations[i] = time.Since(start)
+					log.Printf("INFO: [%d/%d] %s ... %s in %v", i+1, len(targets), target, status, durations[i].Round(time.Second))
+				}()
+			}
+			name := ""
+			if len(targets) > 1 {
+				name = target
+			}
+			stdout, flushOut := commandOutput(os.Stdout, name)
+			defer flushOut()
+			stderr, flushErr := commandOutput(os.Stderr, name)
+			defer flushErr()
+
+			results[i] = build(ctx, target, stdout, stderr)
+			if results[i] != nil && *failFast && ctx.Err() == nil {
+				log.Printf("ERROR: %s failed to build, aborting the remaining targets.", target)
+				cancel()
+			}
+		}(i, target)
+	}
+	pend.Wait()
+
+	// Targets cut short by failing fast are reported as such, not as interrupted
+	for i, err := range results {
+		if err != nil && errors.Is(err, context.Canceled) && parent.Err() == nil {
+			results[i] = errAborted
+		}
+	}
+	for i, target := range targets {
+		targetResults = append(targetResults, targetResult{Target: target, Err: results[i], Duration: durations[i]})
+	}
+	for _, err := range results {
+		if err != nil {
+			return &buildError{Targets: targets, Results: results}
+		}
+	}
+	return nil
+}
+
+// errNoTargets is returned if no targets are left to build once the requested
+// ones are expanded and those the image or build mode cannot build are dropped.
+var errNoTargets = errors.New("no targets to build, none of the requested ones is supported by the image and build mode")
+
+// errAborted is the failure of the targets not built to completion because an
+// other target failed first while failing fast.
+var errAborted = errors.New("aborted after the failure of another target")
+
+// buildError is returned if some of the targets failed to build, tracking the
+// outcome of each of them.
+type buildError struct {
+	Targets []string // Targets that were built
+	Results []error  // Failure of each target, nil if it was built successfully
+}
+
+// Error implements the error interface, listing the failed targets.
+func (e *buildError) Error() string {
+	var failures []string
+	for i, target := range e.Targets {
+		if e.Results[i] != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", target, e.Results[i]))
+		}
+	}
+	return fmt.Sprintf("%d of %d targets failed:\n%s", len(failures), len(e.Targets), strings.Join(failures, "\n"))
+}
+
+// succeeded returns the targets that were built successfully.
+func (e *buildError) succeeded() []string {
+	var targets []string
+	for i, target := range e.Targets {
+		if e.Results[i] == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// failed returns the targets that failed to build.
+func (e *buildError) failed() []string {
+	var targets []string
+	for i, target := range e.Targets {
+		if e.Results[i] != nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets
 }
 
 // resolveImportPath converts a package given by a relative path to a Go import
-// path using the local GOPATH environment.
-func resolveImportPath(path string) string {
+// path, using the module path of its go.mod if any, or the local GOPATH otherwise.
+func resolveImportPath(path string) (string, error) {
 	abs, err := filepath.Abs(path)
 	if err != nil {
-		log.Fatalf("ERROR: Failed to locate requested package: %v.", err)
+		return "", err
 	}
 	stat, err := os.Stat(abs)
-	if err != nil || !stat.IsDir() {
-		log.Fatalf("ERROR: Requested path invalid.")
+	if err != nil {
+		return "", fmt.Errorf("%s does not exist", abs)
 	}
+	if !stat.IsDir() {
+		return "", fmt.Errorf("%s is not a folder", abs)
+	}
+	// Modules define their own import path, regardless of where they are checked out
+	if root := moduleRoot(abs); root != "" {
+		if module := modulePath(root); module != "" {
+			rel, err := filepath.Rel(root, abs)
+			if err != nil {
+				return "", err
+			}
+			return filepath.ToSlash(filepath.Join(module, rel)), nil
+		}
+	}
+	// Without a module, the import path is derived from the location within GOPATH
 	pack, err := build.ImportDir(abs, build.FindOnly)
 	if err != nil {
-		log.Fatalf("ERROR: Failed to resolve import path: %v.", err)
+		return "", err
+	}
+	if pack.ImportPath == "" || build.IsLocalImport(pack.ImportPath) {
+		var nogo *build.NoGoError
+		if _, err := build.ImportDir(abs, 0); errors.As(err, &nogo) {
+			return "", fmt.Errorf("%s is not a Go package, no Go source files found", abs)
+		}
+		return "", fmt.Errorf("%s is outside of GOPATH (%s), move it into a GOPATH src folder or run go mod init to build it as a module", abs, build.Default.GOPATH)
+	}
+	return pack.ImportPath, nil
+}
+
+// Number of trailing output lines retained from a failed command.
+const runErrorLines = 20
+
+// runError is returned by run if a command fails, retaining the tail of its
+// combined output to point at the cause of the failure.
+type runError struct {
+	Cmd    string // Command that was executed
+	Output string // Last lines of the combined output of the command
+	Err    error  // Error the command execution failed with
+}
+
+// Error implements the error interface, including the captured output.
+func (e *runError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %v", e.Cmd, e.Err)
 	}
-	return pack.ImportPath
+	return fmt.Sprintf("%s: %v, last output:\n%s", e.Cmd, e.Err, e.Output)
+}
+
+// Unwrap returns the underlying execution error.
+func (e *runError) Unwrap() error {
+	return e.Err
 }
 
-// Executes a command synchronously, redirecting its output to stdout.
+// Executes a command synchronously, redirecting its output to stdout unless the
+// caller already set up its own streams. The tail of the combined output is also
+// captured to be returned as part of a runError should the command fail.
 func run(cmd *exec.Cmd) error {
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if cmd.Stdout == nil {
+		stdout, flush := commandOutput(os.Stdout, "")
+		defer flush()
+		cmd.Stdout = stdout
+	}
+	if cmd.Stderr == nil {
+		stderr, flush := commandOutput(os.Stderr, "")
+		defer flush()
+		cmd.Stderr = stderr
+	}
+	// Both streams are retained, as failures may be reported on either
+	tail := &tailBuffer{limit: runErrorLines}
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, tail)
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, tail)
+
+	if err := cmd.Run(); err != nil {
+		name := cmd.Args
+		if len(name) > 2 {
+			name = name[:2]
+		}
+		return &runError{
+			Cmd:    strings.Join(name, " "),
+			Output: tail.String(),
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// tailBuffer is an io.Writer retaining only the last few lines written into it.
+type tailBuffer struct {
+	limit int
+	lines [][]byte
+	lock  sync.Mutex
+}
+
+// Write splits the data into lines, dropping the oldest ones above the limit.
+func (t *tailBuffer) Write(data []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		// Continue the last line if it was not terminated yet
+		if n := len(t.lines); n > 0 && !bytes.HasSuffix(t.lines[n-1], []byte("\n")) {
+			t.lines[n-1] = append(t.lines[n-1], line...)
+			continue
+		}
+		t.lines = append(t.lines, append([]byte{}, line...))
+		if len(t.lines) > t.limit {
+			t.lines = t.lines[1:]
+		}
+	}
+	return len(data), nil
+}
+
+// String returns the retained lines, without the trailing newline.
+func (t *tailBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return strings.TrimRight(string(bytes.Join(t.lines, nil)), "\n")
+}
+
+// outputLock serializes the lines written by concurrent prefix writers.
+var outputLock sync.Mutex
+
+// prefixWriter is an io.Writer that prepends a tag to every line written through
+// it, keeping the interleaved output of concurrent builds readable.
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// newPrefixWriter creates a writer tagging each line with the given name, or only
+// splitting the output into lines if the name is empty.
+func newPrefixWriter(out io.Writer, name string) *prefixWriter {
+	if name == "" {
+		return &prefixWriter{out: out}
+	}
+	return &prefixWriter{out: out, prefix: []byte("[" + name + "] ")}
+}
+
+// Write buffers the data and emits every completed line with the prefix.
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := w.emit(w.buf[:idx+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(data), nil
+}
+
+// Flush emits any trailing partial line still buffered.
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.emit(line)
+}
+
+// emit writes a single prefixed line to the underlying writer. Progress bars
+// redraw their line with carriage returns, so only the final state is kept.
+func (w *prefixWriter) emit(line []byte) error {
+	if idx := bytes.LastIndexByte(bytes.TrimRight(line, "\r\n"), '\r'); idx >= 0 {
+		line = line[idx+1:]
+	}
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	_, err := w.out.Write(append(append([]byte{}, w.prefix...), line...))
+	return err
+}
+
+// cleanOutputs removes the outputs of previous builds from the destination folder
+// so targets dropped from the build matrix do not leave stale binaries behind.
+func cleanOutputs(folder string, config *ConfigFlags) error {
+	files, err := staleOutputs(folder, config)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if *dryRun {
+			fmt.Println(shellQuote([]string{"rm", filepath.Join(folder, filepath.FromSlash(file))}))
+			continue
+		}
+		log.Printf("INFO: Removing stale output %s...", file)
+		if err := os.Remove(filepath.Join(folder, filepath.FromSlash(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable verifies that files can be created in the given folder.
+func checkWritable(folder string) error {
+	probe, err := os.CreateTemp(folder, ".xgo-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// shellQuote joins command arguments into a string which can be pasted into a
+// POSIX shell, quoting the arguments which contain special characters.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		safe := arg != ""
+		for _, c := range arg {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_@%+=:,./-", c)) {
+				safe = false
+				break
+			}
+		}
+		if safe {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// stringsFlag is a command line flag which can be repeated, collecting all the
+// values it was given.
+type stringsFlag []string
+
+// stringsFlagVar defines a repeatable string flag with the specified name and
+// usage string.
+func stringsFlagVar(name string, usage string) *stringsFlag {
+	values := new(stringsFlag)
+	flag.Var(values, name, usage)
+	return values
+}
+
+// String implements flag.Value, joining the collected values.
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value, appending a new value.
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// gitDependency splits a dependency given as git+<url>[#<ref>] into the URL of
+// the repository to clone and the tag or branch to check out, if any. Whether it
+// is a git dependency at all is returned last, with an empty URL if malformed.
+func gitDependency(dep string) (string, string, bool) {
+	if !strings.HasPrefix(dep, "git+") {
+		return "", "", false
+	}
+	url, ref := strings.TrimPrefix(dep, "git+"), ""
+	if idx := strings.LastIndex(url, "#"); idx >= 0 {
+		url, ref = url[:idx], url[idx+1:]
+	}
+	if !strings.Contains(url, "://") || strings.ContainsAny(ref, " \t") || strings.HasPrefix(ref, "-") {
+		return "", "", true
+	}
+	return url, ref, true
+}
+
+// gitRoot looks for the root of the git work tree a folder belongs to, returning
+// it along with whether its repository lies within, as opposed to worktrees and
+// submodules pointing elsewhere with a .git file. An empty root is returned if
+// the folder is not part of any git work tree.
+func gitRoot(dir string) (string, bool) {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, info.IsDir()
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// isLocal checks whether a repository to build refers to a local path instead of
+// an import path.
+func isLocal(repository string) bool {
+	return strings.HasPrefix(repository, string(filepath.Separator)) || strings.HasPrefix(repository, ".")
+}
+
+// mountedPackage checks whether a package can be found within the src folders of
+// the GOPATH elements mounted into the build container, mapping its path within
+// the container back to the host folder mounted there.
+func mountedPackage(locals []string, mounts []string, paths []string, pkg string) bool {
+	for _, gopath := range paths {
+		dir, best := path.Join(gopath, "src", pkg), -1
+		for i, mount := range mounts {
+			mount = filepath.ToSlash(mount)
+			if (dir == mount || strings.HasPrefix(dir, mount+"/")) && (best < 0 || len(mount) > len(mounts[best])) {
+				best = i
+			}
+		}
+		if best >= 0 && isDir(filepath.Join(locals[best], filepath.FromSlash(strings.TrimPrefix(dir, filepath.ToSlash(mounts[best]))))) {
+			return true
+		}
+	}
+	return false
+}
 
-	return cmd.Run()
+// isDir checks if given path exists and is a folder.
+func isDir(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
 }
 
 // fileExists checks if given file exists